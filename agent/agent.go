@@ -1,69 +1,167 @@
 package agent
 
 import (
-	"encoding/json"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/docker/engine-api/client"
-	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/events"
-	"github.com/docker/engine-api/types/filters"
+	"github.com/rancher/secrets-bridge/metrics"
+	"github.com/rancher/secrets-bridge/writer"
 	"github.com/urfave/cli"
-	"golang.org/x/net/context"
 )
 
 func StartAgent(c *cli.Context) {
-	cli, err := getDockerClient()
+	runtime, err := newRuntime(c)
 	if err != nil {
-		logrus.Fatalf("Could not get Docker client: %s", err)
+		logrus.Fatalf("Could not get container runtime: %s", err)
 	}
 
-	filterArgs := filters.NewArgs()
-	filterArgs.Add("event", "start")
+	// the reconciler and local API only know how to find Docker containers
+	docker, isDocker := runtime.(*dockerRuntime)
 
-	eventOptions := types.EventsOptions{
-		Filters: filterArgs,
+	actions := []string{"start"}
+	if c.Bool("deliver-on-create") && !isDocker {
+		logrus.Warnf("--deliver-on-create is only supported with Docker")
+	}
+	// volume writer directories are made when their container is created
+	if isDocker && (c.Bool("deliver-on-create") || c.String("volume-dir") != "") {
+		actions = append(actions, "create")
 	}
 
-	eventsResp, err := cli.Events(context.Background(), eventOptions)
-	if err != nil {
-		logrus.Fatal(err)
+	// destroyed containers lose their volume and their renewed token
+	actions = append(actions, "destroy")
+
+	volumeDir := c.String("volume-dir")
+	if volumeDir != "" {
+		if err := writer.PrepareVolumeDir(volumeDir); err != nil {
+			logrus.Warnf("Could not prepare volume dir %s: %s", volumeDir, err)
+		}
 	}
-	defer eventsResp.Close()
 
-	bridgeUrl := strings.TrimSuffix(c.String("bridge-url"), "/")
-	logrus.Debugf("Sending events to: %s", bridgeUrl)
+	deliveries := newDeliveryLog(c.String("state-dir"))
 
-	handler, err := NewMessageHandler(map[string]interface{}{
-		"metadata-url": c.String("metadata-url"),
-		"bridge-url":   bridgeUrl + "/v1/message",
-	})
+	handler, err := newHandler(c, runtime, deliveries)
 	if err != nil {
 		logrus.Fatalf("Error: %s", err)
 	}
 
-	logrus.Info("Entering event listening Loop")
-	d := json.NewDecoder(eventsResp)
-	for {
-		msg := &events.Message{}
-		d.Decode(msg)
+	checkpoint := newEventCheckpoint(c.String("state-dir"))
+
+	retries := newSpool(c.String("state-dir"), c.Duration("retry-window"))
+
+	handle := eventHandler(handler, deliveries, checkpoint, retries, volumeDir, c.String("state-dir"))
+	pool := newWorkerPool(handle, supersededHandler(checkpoint, retries), c.Int("workers"), c.Int("queue-size"))
 
-		// For now... will need to add some throttling at some point.
-		go wrapHandler(handler.Handle, msg)
+	stream := newEventStream(runtime, actions, checkpoint)
+
+	stopBackground := make(chan struct{})
+	if c.Bool("reconcile") && isDocker {
+		r := newReconciler(docker.client, handler, deliveries, pool, c.Duration("reconcile-rate"))
+		go r.Run(c.Duration("reconcile-interval"), stopBackground)
+	}
+	go retries.Run(pool, stopBackground)
+	go runHeartbeat(runtime, handler, c.Duration("heartbeat-interval"), stopBackground)
+	go metrics.Serve(c.String("metrics-listen"), "deliveryHooks")
+
+	if listen := c.String("local-api"); listen != "" && isDocker {
+		go func() {
+			if err := serveLocalAPI(listen, docker.client, handler); err != nil {
+				logrus.Fatalf("Local credential API failed: %s", err)
+			}
+		}()
+	} else if listen != "" {
+		logrus.Warnf("--local-api is only supported with Docker")
 	}
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		sig := <-signals
+		logrus.Infof("Received %s, draining in-flight events", sig)
+		close(stopBackground)
+		stream.Stop()
+	}()
+
+	logrus.Info("Entering event listening Loop")
+	stream.Run(pool)
+
+	pool.Stop()
 	os.Exit(0)
 }
 
+// eventHandler handles an event from the pool, settling its checkpoint and
+// spooled delivery.
+func eventHandler(handler MessageHandler, deliveries *deliveryLog, checkpoint *eventCheckpoint, retries *spool, volumeDir, stateDir string) func(*events.Message) error {
+	return func(msg *events.Message) (err error) {
+		// whatever happens, a spooled delivery is settled
+		defer func() {
+			if err != nil {
+				retries.Failed(msg, err)
+			} else {
+				retries.Delivered(msg)
+			}
+		}()
+
+		if msg.Action == notifyAction {
+			return handler.Notify(msg)
+		}
+
+		// reconciled containers don't come from the stream, and may have
+		// been handled from it while they waited in the queue
+		if msg.TimeNano == 0 {
+			if deliveries.Has(msg.ID) {
+				return nil
+			}
+		} else {
+			defer checkpoint.Done(msg.TimeNano)
+		}
+
+		if msg.Action == "destroy" {
+			if err := handler.Release(msg); err != nil {
+				logrus.Warnf("Could not report destroyed container %s: %s", msg.ID, err)
+			}
+			writer.ForgetContainer(msg.ID)
+			return writer.RemoveVolume(volumeDir, stateDir, msg.ID)
+		}
+
+		return handler.Handle(msg)
+	}
+}
+
+// supersededHandler settles an event the pool dropped for a newer event of
+// the same container.
+func supersededHandler(checkpoint *eventCheckpoint, retries *spool) func(*events.Message) {
+	return func(msg *events.Message) {
+		retries.Delivered(msg)
+		if msg.TimeNano != 0 && msg.Action != notifyAction {
+			checkpoint.Done(msg.TimeNano)
+		}
+	}
+}
+
+func newHandler(c *cli.Context, runtime Runtime, deliveries *deliveryLog) (MessageHandler, error) {
+	bridgeUrl := strings.TrimSuffix(c.String("bridge-url"), "/")
+	logrus.Debugf("Sending events to: %s", bridgeUrl)
+
+	return NewMessageHandler(map[string]interface{}{
+		"metadata-url":      c.String("metadata-url"),
+		"bridge-url":        bridgeUrl + "/v1/message",
+		"heartbeat-url":     bridgeUrl + "/v1/heartbeat",
+		"environment":       c.String("environment"),
+		"deliveries":        deliveries,
+		"volume-dir":        c.String("volume-dir"),
+		"state-dir":         c.String("state-dir"),
+		"deliver-on-create": c.Bool("deliver-on-create"),
+		"runtime":           runtime,
+	})
+}
+
 func wrapHandler(handlerFunc func(*events.Message) error, msg *events.Message) {
 	if err := handlerFunc(msg); err != nil {
 		logrus.Debugf("Warning: %s", err)
 	}
 }
-
-func getDockerClient() (*client.Client, error) {
-	defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
-	return client.NewClient("unix:///var/run/docker.sock", "v1.22", nil, defaultHeaders)
-}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const checkpointFile = "events.checkpoint"
+
+// eventCheckpoint is how far the event stream has been handled, so a restart replays the rest.
+type eventCheckpoint struct {
+	mu      sync.Mutex
+	path    string
+	latest  int64
+	pending map[int64]int
+}
+
+type checkpointState struct {
+	TimeNano int64 `json:"timeNano"`
+}
+
+func newEventCheckpoint(stateDir string) *eventCheckpoint {
+	cp := &eventCheckpoint{
+		latest:  time.Now().UnixNano(),
+		pending: map[int64]int{},
+	}
+
+	if stateDir == "" {
+		return cp
+	}
+
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		logrus.Warnf("Can not create state dir, event checkpoints will not persist: %s", err)
+		return cp
+	}
+	cp.path = filepath.Join(stateDir, checkpointFile)
+
+	content, err := ioutil.ReadFile(cp.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Warnf("Can not read event checkpoint: %s", err)
+		}
+		return cp
+	}
+
+	state := &checkpointState{}
+	if err := json.Unmarshal(content, state); err != nil {
+		logrus.Warnf("Ignoring corrupt event checkpoint: %s", err)
+		return cp
+	}
+
+	if state.TimeNano > 0 {
+		cp.latest = state.TimeNano
+		logrus.Infof("Resuming Docker events from %s", time.Unix(0, state.TimeNano))
+	}
+
+	return cp
+}
+
+// Begin marks an event as accepted for handling.
+func (cp *eventCheckpoint) Begin(timeNano int64) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.pending[timeNano]++
+}
+
+// Done marks an accepted event as handled and persists the new checkpoint.
+func (cp *eventCheckpoint) Done(timeNano int64) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.pending[timeNano] <= 1 {
+		delete(cp.pending, timeNano)
+	} else {
+		cp.pending[timeNano]--
+	}
+
+	if timeNano > cp.latest {
+		cp.latest = timeNano
+	}
+
+	cp.save()
+}
+
+// TimeNano is the latest point at which no accepted event is unhandled.
+func (cp *eventCheckpoint) TimeNano() int64 {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	return cp.timeNano()
+}
+
+// Since formats the first unhandled moment for the Docker events `since` option.
+func (cp *eventCheckpoint) Since() string {
+	ts := cp.TimeNano() + 1
+	return fmt.Sprintf("%d.%09d", ts/int64(time.Second), ts%int64(time.Second))
+}
+
+func (cp *eventCheckpoint) timeNano() int64 {
+	oldest := cp.latest
+	for ts := range cp.pending {
+		if ts <= oldest {
+			oldest = ts - 1
+		}
+	}
+	return oldest
+}
+
+func (cp *eventCheckpoint) save() {
+	if cp.path == "" {
+		return
+	}
+
+	content, err := json.Marshal(&checkpointState{TimeNano: cp.timeNano()})
+	if err != nil {
+		logrus.Warnf("Can not encode event checkpoint: %s", err)
+		return
+	}
+
+	tmp := cp.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		logrus.Warnf("Can not write event checkpoint: %s", err)
+		return
+	}
+
+	if err := os.Rename(tmp, cp.path); err != nil {
+		logrus.Warnf("Can not write event checkpoint: %s", err)
+	}
+}
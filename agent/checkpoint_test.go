@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types/events"
+)
+
+func TestEventCheckpoint(t *testing.T) {
+	type op struct {
+		begin    bool
+		timeNano int64
+	}
+	begin := func(ts int64) op { return op{true, ts} }
+	done := func(ts int64) op { return op{false, ts} }
+
+	tests := []struct {
+		name string
+		ops  []op
+		want int64
+	}{
+		{"nothing handled", nil, 100},
+		{"pending holds back", []op{begin(110)}, 100},
+		{"done advances", []op{begin(110), done(110)}, 110},
+		{"oldest pending holds back", []op{begin(110), begin(120), done(120)}, 109},
+		{"out of order done", []op{begin(110), begin(120), done(120), done(110)}, 120},
+		{"same timestamp twice", []op{begin(110), begin(110), done(110)}, 109},
+		{"same timestamp both done", []op{begin(110), begin(110), done(110), done(110)}, 110},
+		{"replayed old event", []op{begin(90), done(90)}, 100},
+		{"pending before checkpoint", []op{begin(90)}, 89},
+	}
+
+	for _, test := range tests {
+		cp := newEventCheckpoint("")
+		cp.latest = 100
+
+		for _, o := range test.ops {
+			if o.begin {
+				cp.Begin(o.timeNano)
+			} else {
+				cp.Done(o.timeNano)
+			}
+		}
+
+		if got := cp.TimeNano(); got != test.want {
+			t.Errorf("%s: checkpoint is %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEventCheckpointPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets-bridge-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cp := newEventCheckpoint(dir)
+	ts := time.Now().Add(time.Hour).UnixNano()
+	cp.Begin(ts)
+	cp.Done(ts)
+
+	if got := newEventCheckpoint(dir).TimeNano(); got != ts {
+		t.Errorf("restored checkpoint is %d, want %d", got, ts)
+	}
+}
+
+func TestEventStreamPrune(t *testing.T) {
+	tests := []struct {
+		name       string
+		checkpoint int64
+		seen       map[string]int64
+		want       []string
+	}{
+		{"empty", 100, map[string]int64{}, nil},
+		{"all handled", 100, map[string]int64{"a": 90, "b": 100}, nil},
+		{"keeps replayable", 100, map[string]int64{"a": 90, "b": 101, "c": 150}, []string{"b", "c"}},
+	}
+
+	for _, test := range tests {
+		cp := newEventCheckpoint("")
+		cp.latest = test.checkpoint
+
+		es := newEventStream(nil, nil, cp)
+		es.seen = test.seen
+		es.prune()
+
+		if len(es.seen) != len(test.want) {
+			t.Errorf("%s: kept %v, want %v", test.name, es.seen, test.want)
+			continue
+		}
+		for _, key := range test.want {
+			if _, ok := es.seen[key]; !ok {
+				t.Errorf("%s: dropped %s", test.name, key)
+			}
+		}
+		if es.prunedAt != test.checkpoint {
+			t.Errorf("%s: pruned at %d, want %d", test.name, es.prunedAt, test.checkpoint)
+		}
+	}
+}
+
+// replayRuntime hands out one scripted connection per Events call, each
+// replaying the events from since on like Docker does.
+type replayRuntime struct {
+	Runtime
+
+	mu          sync.Mutex
+	connections [][]*events.Message
+}
+
+func (r *replayRuntime) Events(since string, actions []string) (EventReader, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.connections) == 0 {
+		return nil, errors.New("no more connections")
+	}
+	script := r.connections[0]
+	r.connections = r.connections[1:]
+
+	parts := strings.SplitN(since, ".", 2)
+	secs, _ := strconv.ParseInt(parts[0], 10, 64)
+	nanos, _ := strconv.ParseInt(parts[1], 10, 64)
+	from := secs*int64(time.Second) + nanos
+
+	reader := &replayReader{closed: make(chan struct{}), last: len(r.connections) == 0}
+	for _, msg := range script {
+		if msg.TimeNano >= from {
+			reader.events = append(reader.events, msg)
+		}
+	}
+	return reader, nil
+}
+
+type replayReader struct {
+	events []*events.Message
+	last   bool
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (r *replayReader) Next() (*events.Message, error) {
+	if len(r.events) > 0 {
+		msg := r.events[0]
+		r.events = r.events[1:]
+		return msg, nil
+	}
+	if !r.last {
+		return nil, errors.New("connection dropped")
+	}
+	<-r.closed
+	return nil, io.EOF
+}
+
+func (r *replayReader) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	return nil
+}
+
+func TestEventStreamSkipsReplayedEvents(t *testing.T) {
+	base := time.Now().UnixNano()
+	event := func(id string, offset int64) *events.Message {
+		return &events.Message{ID: id, Action: "start", TimeNano: base + offset}
+	}
+
+	runtime := &replayRuntime{
+		connections: [][]*events.Message{
+			{event("a", 10), event("b", 20), event("c", 30)},
+			{event("a", 10), event("b", 20), event("c", 30), event("d", 40)},
+		},
+	}
+
+	cp := newEventCheckpoint("")
+	cp.latest = base
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	handled := map[string]int{}
+	total := make(chan struct{}, 10)
+
+	handler := func(msg *events.Message) error {
+		defer cp.Done(msg.TimeNano)
+		// b is still being handled when the stream drops, so it holds the
+		// checkpoint back and is replayed with c
+		if msg.ID == "b" {
+			<-release
+		}
+
+		mu.Lock()
+		handled[msg.ID]++
+		mu.Unlock()
+		total <- struct{}{}
+		return nil
+	}
+
+	pool := newWorkerPool(handler, nil, 4, 10)
+	es := newEventStream(runtime, []string{"start"}, cp)
+	go es.Run(pool)
+
+	wait := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case <-total:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("only %d events were handled", i)
+			}
+		}
+	}
+
+	// a, c and the new d
+	wait(3)
+	close(release)
+	wait(1)
+
+	es.Stop()
+	pool.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if handled[id] != 1 {
+			t.Errorf("%s was handled %d times, want once", id, handled[id])
+		}
+	}
+}
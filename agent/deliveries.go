@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const deliveriesDir = "deliveries"
+
+// deliveryLog remembers which containers have been handed credentials, one
+// file per container ID, so reconciliation can skip them.
+type deliveryLog struct {
+	dir string
+}
+
+func newDeliveryLog(stateDir string) *deliveryLog {
+	if stateDir == "" {
+		return &deliveryLog{}
+	}
+
+	dir := filepath.Join(stateDir, deliveriesDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logrus.Warnf("Can not create delivery log, deliveries will not be recorded: %s", err)
+		return &deliveryLog{}
+	}
+
+	return &deliveryLog{dir: dir}
+}
+
+func (dl *deliveryLog) Record(containerID string) {
+	if dl.dir == "" || containerID == "" {
+		return
+	}
+
+	ts := []byte(time.Now().UTC().Format(time.RFC3339))
+	if err := ioutil.WriteFile(filepath.Join(dl.dir, containerID), ts, 0600); err != nil {
+		logrus.Warnf("Can not record delivery to %s: %s", containerID, err)
+	}
+}
+
+func (dl *deliveryLog) Has(containerID string) bool {
+	if dl.dir == "" || containerID == "" {
+		return false
+	}
+
+	_, err := os.Stat(filepath.Join(dl.dir, containerID))
+	return err == nil
+}
+
+// Prune forgets containers that are no longer running.
+func (dl *deliveryLog) Prune(running map[string]bool) {
+	if dl.dir == "" {
+		return
+	}
+
+	files, err := ioutil.ReadDir(dl.dir)
+	if err != nil {
+		logrus.Warnf("Can not read delivery log: %s", err)
+		return
+	}
+
+	for _, file := range files {
+		if !running[file.Name()] {
+			os.Remove(filepath.Join(dl.dir, file.Name()))
+		}
+	}
+}
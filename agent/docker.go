@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types/versions"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// The agent needs at least the events API of 1.22, and the client library
+// speaks up to 1.24. Newer daemons still accept 1.24.
+const (
+	minDockerAPIVersion = "1.22"
+	maxDockerAPIVersion = "1.24"
+)
+
+func getDockerClient(c *cli.Context) (*client.Client, error) {
+	var httpClient *http.Client
+
+	certPath := c.String("docker-cert-path")
+	if certPath != "" || c.Bool("docker-tls-verify") {
+		options := tlsconfig.Options{
+			InsecureSkipVerify: !c.Bool("docker-tls-verify"),
+		}
+		if certPath != "" {
+			options.CAFile = filepath.Join(certPath, "ca.pem")
+			options.CertFile = filepath.Join(certPath, "cert.pem")
+			options.KeyFile = filepath.Join(certPath, "key.pem")
+		}
+
+		tlsc, err := tlsconfig.Client(options)
+		if err != nil {
+			return nil, err
+		}
+
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsc,
+			},
+		}
+	}
+
+	defaultHeaders := map[string]string{"User-Agent": "engine-api-cli-1.0"}
+	dockerClient, err := client.NewClient(c.String("docker-host"), "", httpClient, defaultHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	version := strings.TrimPrefix(c.String("docker-api-version"), "v")
+	if version == "" {
+		version = negotiateAPIVersion(dockerClient)
+	}
+	dockerClient.UpdateClientVersion(version)
+
+	logrus.Infof("Using Docker API %s on %s", version, c.String("docker-host"))
+
+	return dockerClient, nil
+}
+
+// negotiateAPIVersion settles on the daemon's API version, within what the
+// agent can speak.
+func negotiateAPIVersion(dockerClient *client.Client) string {
+	serverVersion, err := dockerClient.ServerVersion(context.Background())
+	if err != nil {
+		logrus.Warnf("Could not get the Docker API version, using %s: %s", minDockerAPIVersion, err)
+		return minDockerAPIVersion
+	}
+
+	version := serverVersion.APIVersion
+	if versions.GreaterThan(version, maxDockerAPIVersion) {
+		return maxDockerAPIVersion
+	}
+	if versions.LessThan(version, minDockerAPIVersion) {
+		logrus.Warnf("Docker API %s is older than %s, some deliveries may fail", version, minDockerAPIVersion)
+	}
+	return version
+}
@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/secrets-bridge/doctor"
+	"github.com/urfave/cli"
+)
+
+const doctorTimeout = 10 * time.Second
+
+// bridgeHealth is what the bridge answers on /v1/health.
+type bridgeHealth struct {
+	SignatureVerified bool   `json:"signatureVerified"`
+	MaxClockSkew      string `json:"maxClockSkew"`
+}
+
+// DoctorAgent checks what the agent needs on its host and from the bridge,
+// with the same flags the agent is started with.
+func DoctorAgent(c *cli.Context) {
+	report := doctor.NewReport()
+
+	checkRuntime(report, c)
+
+	self, ok := checkMetadata(report, c.String("metadata-url"))
+
+	signingKey, source := agentSigningKey()
+	if signingKey == "" {
+		report.Fail("Signing key", errors.New("SECRETS_BRIDGE_SIGNING_KEY and CATTLE_SECRET_KEY are not set"),
+			"set SECRETS_BRIDGE_SIGNING_KEY to the bridge's --agent-signing-key")
+	} else {
+		report.Pass("Signing key", source+" is set")
+	}
+
+	bridgeUrl := strings.TrimSuffix(c.String("bridge-url"), "/")
+	health, reachable := checkBridge(report, bridgeUrl)
+	if !reachable {
+		report.Exit()
+	}
+
+	if !health.SignatureVerified {
+		report.Skip("Signature", "the bridge doesn't verify signatures, start it with --agent-signing-key")
+		report.Exit()
+	}
+
+	if !ok || signingKey == "" {
+		report.Skip("Signature", "needs rancher-metadata and the signing key")
+		report.Exit()
+	}
+
+	handler := &JsonHandler{
+		agentUUID:  self.UUID,
+		signingKey: signingKey,
+	}
+	checkSignature(report, handler, bridgeUrl+"/v1/message")
+
+	report.Exit()
+}
+
+func checkRuntime(report *doctor.Report, c *cli.Context) {
+	check := "Container runtime"
+
+	hint := "check --docker-host and that the Docker socket is mounted into the agent"
+	if c.String("runtime") == "containerd" {
+		hint = "check --containerd-ctr, --containerd-address and that the socket is mounted into the agent"
+	}
+
+	runtime, err := newRuntime(c)
+	if err != nil {
+		report.Fail(check, err, hint)
+		return
+	}
+
+	running, err := runtime.Running()
+	if err != nil {
+		report.Fail(check, err, hint)
+		return
+	}
+
+	report.Pass(check, fmt.Sprintf("%s, %d running containers", c.String("runtime"), len(running)))
+}
+
+func checkMetadata(report *doctor.Report, url string) (metadata.Container, bool) {
+	check := "Rancher metadata"
+
+	type result struct {
+		self metadata.Container
+		err  error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		self, err := metadata.NewClient(url).GetSelfContainer()
+		done <- result{self, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			report.Fail(check, r.err, "check --metadata-url and that the agent runs on Rancher's managed network")
+			return r.self, false
+		}
+		if r.self.UUID == "" {
+			report.Fail(check, errors.New("metadata doesn't know the agent's container"),
+				"run the agent as a Rancher service, not with docker run")
+			return r.self, false
+		}
+		report.Pass(check, fmt.Sprintf("%s, agent container %s", url, r.self.Name))
+		return r.self, true
+	case <-time.After(doctorTimeout):
+		report.Fail(check, fmt.Errorf("%s did not answer within %s", url, doctorTimeout),
+			"check --metadata-url and that the agent runs on Rancher's managed network")
+		return metadata.Container{}, false
+	}
+}
+
+// checkBridge reaches the bridge's health endpoint and compares its clock,
+// which the signature's timestamp depends on, with ours.
+func checkBridge(report *doctor.Report, bridgeUrl string) (*bridgeHealth, bool) {
+	health := &bridgeHealth{}
+
+	if bridgeUrl == "" {
+		report.Fail("Bridge", errors.New("--bridge-url is not set"), "set --bridge-url to http://<bridge>:8181")
+		return health, false
+	}
+
+	client := &http.Client{Timeout: doctorTimeout}
+	resp, err := client.Get(bridgeUrl + "/v1/health")
+	if err != nil {
+		report.Fail("Bridge", err, "check --bridge-url and that port 8181 of the bridge is reachable from this host")
+		return health, false
+	}
+	defer resp.Body.Close()
+	now := time.Now()
+
+	if resp.StatusCode != http.StatusOK {
+		report.Fail("Bridge", fmt.Errorf("%s answered %d", bridgeUrl, resp.StatusCode),
+			"check that --bridge-url points at a secrets-bridge server")
+		return health, false
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(health); err != nil {
+		report.Fail("Bridge", err, "check that --bridge-url points at a secrets-bridge server")
+		return health, false
+	}
+	report.Pass("Bridge", bridgeUrl)
+
+	maxClockSkew, err := time.ParseDuration(health.MaxClockSkew)
+	if err != nil {
+		report.Skip("Clock skew", "the bridge sent no clock skew limit")
+		return health, true
+	}
+
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		report.Skip("Clock skew", "the bridge sent no Date header")
+		return health, true
+	}
+
+	skew := now.Sub(serverTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	// the header only has whole seconds
+	if skew > maxClockSkew+time.Second {
+		report.Fail("Clock skew", fmt.Errorf("%s apart from the bridge, which allows %s", skew, maxClockSkew),
+			"synchronise the clocks of both hosts with NTP")
+		return health, true
+	}
+	report.Pass("Clock skew", fmt.Sprintf("%s apart from the bridge", skew/time.Second*time.Second))
+
+	return health, true
+}
+
+// checkSignature sends a signed message the bridge doesn't act on. It
+// rejects bad signatures before looking at what the message asks for.
+func checkSignature(report *doctor.Report, handler *JsonHandler, url string) {
+	check := "Signature"
+
+	resp, err := handler.postRequestToSecretBridge(url, bytes.NewBufferString(`{"Action":"doctor"}`))
+	if err != nil {
+		report.Fail(check, err, "check --bridge-url")
+		return
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotImplemented:
+		report.Pass(check, "accepted by the bridge")
+	case http.StatusForbidden:
+		report.Fail(check, errors.New("rejected by the bridge"),
+			"SECRETS_BRIDGE_SIGNING_KEY must match the bridge's --agent-signing-key")
+	default:
+		report.Fail(check, fmt.Errorf("bridge answered %d", resp.StatusCode), "check the bridge's log")
+	}
+}
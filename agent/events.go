@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var errStreamStopped = errors.New("event stream stopped")
+
+// eventStream follows the runtime's event stream across daemon restarts
+// and dropped connections, replaying from the checkpoint on every reconnect.
+type eventStream struct {
+	runtime    Runtime
+	actions    []string
+	checkpoint *eventCheckpoint
+	seen       map[string]int64
+	prunedAt   int64
+	stop       chan struct{}
+
+	mu     sync.Mutex
+	stream EventReader
+}
+
+func newEventStream(runtime Runtime, actions []string, checkpoint *eventCheckpoint) *eventStream {
+	return &eventStream{
+		runtime:    runtime,
+		actions:    actions,
+		checkpoint: checkpoint,
+		seen:       map[string]int64{},
+		stop:       make(chan struct{}),
+	}
+}
+
+// Run feeds events to the pool until Stop is called.
+func (es *eventStream) Run(pool *workerPool) {
+	backoff := 1 * time.Second
+	maxBackoff := 30 * time.Second
+
+	for {
+		connected, err := es.listen(pool)
+		if err == errStreamStopped {
+			return
+		}
+
+		if connected {
+			backoff = 1 * time.Second
+		}
+
+		logrus.Warnf("Event stream dropped, reconnecting in %s: %s", backoff, err)
+
+		select {
+		case <-es.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff < maxBackoff {
+			backoff *= 2
+		}
+	}
+}
+
+// Stop closes the current stream and ends Run.
+func (es *eventStream) Stop() {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	close(es.stop)
+	if es.stream != nil {
+		es.stream.Close()
+	}
+}
+
+func (es *eventStream) listen(pool *workerPool) (bool, error) {
+	since := es.checkpoint.Since()
+	es.prune()
+
+	eventsResp, err := es.runtime.Events(since, es.actions)
+	if err != nil {
+		return false, err
+	}
+	defer eventsResp.Close()
+
+	es.mu.Lock()
+	select {
+	case <-es.stop:
+		es.mu.Unlock()
+		return false, errStreamStopped
+	default:
+	}
+	es.stream = eventsResp
+	es.mu.Unlock()
+
+	logrus.Infof("Listening for container events since %s", since)
+
+	for {
+		msg, err := eventsResp.Next()
+		if err != nil {
+			select {
+			case <-es.stop:
+				return true, errStreamStopped
+			default:
+			}
+
+			if err == io.EOF {
+				return true, errors.New("stream closed by the runtime")
+			}
+			return true, err
+		}
+
+		if msg.ID == "" {
+			logrus.Debugf("Skipping event without a container ID: %#v", msg)
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%s/%d", msg.ID, msg.Action, msg.TimeNano)
+		if _, ok := es.seen[key]; ok {
+			logrus.Debugf("Skipping replayed %s event for %s", msg.Action, msg.ID)
+			continue
+		}
+		es.seen[key] = msg.TimeNano
+
+		// only events since the checkpoint can be replayed, so the seen
+		// map stays as small as the events in flight
+		if es.checkpoint.TimeNano() > es.prunedAt {
+			es.prune()
+		}
+
+		es.checkpoint.Begin(msg.TimeNano)
+		if !pool.Submit(msg) {
+			es.checkpoint.Done(msg.TimeNano)
+			return true, errStreamStopped
+		}
+	}
+}
+
+// prune forgets events from before the checkpoint, they can't be replayed.
+func (es *eventStream) prune() {
+	ts := es.checkpoint.TimeNano()
+	es.prunedAt = ts
+	for key, timeNano := range es.seen {
+		if timeNano <= ts {
+			delete(es.seen, key)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formatter renders the bridge's response as the contents of the file
+// handed to a container.
+type Formatter func(*VaultResponseThing) (string, error)
+
+var (
+	formattersMu sync.RWMutex
+	formatters   = map[string]Formatter{}
+)
+
+func init() {
+	RegisterFormat("shell", formatShell)
+	RegisterFormat("dotenv", formatDotenv)
+	RegisterFormat("json", formatJSON)
+	RegisterFormat("yaml", formatYAML)
+	RegisterFormat("vault-agent", formatVaultAgent)
+}
+
+// RegisterFormat makes a formatter available to the secrets.bridge.format label.
+func RegisterFormat(name string, formatter Formatter) {
+	formattersMu.Lock()
+	defer formattersMu.Unlock()
+
+	formatters[name] = formatter
+}
+
+func Formats() []string {
+	formattersMu.RLock()
+	defer formattersMu.RUnlock()
+
+	names := []string{}
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validFormat(name string) bool {
+	formattersMu.RLock()
+	defer formattersMu.RUnlock()
+
+	_, ok := formatters[name]
+	return ok
+}
+
+func formatMessage(message *VaultResponseThing, format string) (string, error) {
+	formattersMu.RLock()
+	formatter, ok := formatters[format]
+	formattersMu.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("Unknown format: %s", format)
+	}
+
+	return formatter(message)
+}
+
+// secretVars are the values every format carries, in the order they are
+// written.
+func secretVars(message *VaultResponseThing) [][2]string {
+	return [][2]string{
+		{"CUBBY_PATH", message.CubbyPath},
+		{"TEMP_TOKEN", message.TempToken},
+		{"VAULT_ADDR", message.VaultAddr},
+		{"VAULT_CA_BUNDLE", message.CABundle},
+		{"TEMP_TOKEN_TTL", strconv.Itoa(message.TTL)},
+		{"TEMP_TOKEN_EXPIRES", formatExpires(message.Expires)},
+	}
+}
+
+func formatShell(message *VaultResponseThing) (string, error) {
+	buf := &bytes.Buffer{}
+	for _, v := range secretVars(message) {
+		fmt.Fprintf(buf, "export %s=%s\n", v[0], shellQuote(v[1]))
+	}
+	return buf.String(), nil
+}
+
+func formatDotenv(message *VaultResponseThing) (string, error) {
+	buf := &bytes.Buffer{}
+	for _, v := range secretVars(message) {
+		value := v[1]
+		if strings.ContainsAny(value, "\n\"# ") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(buf, "%s=%s\n", v[0], value)
+	}
+	return buf.String(), nil
+}
+
+func formatJSON(message *VaultResponseThing) (string, error) {
+	content, err := json.MarshalIndent(map[string]interface{}{
+		"cubbyPath": message.CubbyPath,
+		"tempToken": message.TempToken,
+		"vaultAddr": message.VaultAddr,
+		"caBundle":  message.CABundle,
+		"ttl":       message.TTL,
+		"expires":   formatExpires(message.Expires),
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(content) + "\n", nil
+}
+
+func formatYAML(message *VaultResponseThing) (string, error) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "cubbyPath: %s\n", strconv.Quote(message.CubbyPath))
+	fmt.Fprintf(buf, "tempToken: %s\n", strconv.Quote(message.TempToken))
+	fmt.Fprintf(buf, "vaultAddr: %s\n", strconv.Quote(message.VaultAddr))
+	if message.CABundle == "" {
+		fmt.Fprint(buf, "caBundle: \"\"\n")
+	} else {
+		fmt.Fprint(buf, "caBundle: |\n")
+		for _, line := range strings.Split(strings.TrimRight(message.CABundle, "\n"), "\n") {
+			fmt.Fprintf(buf, "  %s\n", line)
+		}
+	}
+	fmt.Fprintf(buf, "ttl: %d\n", message.TTL)
+	fmt.Fprintf(buf, "expires: %s\n", strconv.Quote(formatExpires(message.Expires)))
+	return buf.String(), nil
+}
+
+// formatVaultAgent writes a Vault Agent config, its token file is left to the app to fill.
+func formatVaultAgent(message *VaultResponseThing) (string, error) {
+	buf := &bytes.Buffer{}
+	fmt.Fprint(buf, "# Read permKey from cubby_path with temp_token and write it to\n")
+	fmt.Fprint(buf, "# token_file_path before starting vault agent with this file.\n")
+	fmt.Fprintf(buf, "# cubby_path = %s\n", strconv.Quote(message.CubbyPath))
+	fmt.Fprintf(buf, "# temp_token = %s\n", strconv.Quote(message.TempToken))
+	fmt.Fprintf(buf, "# temp_token_ttl = %d\n", message.TTL)
+	fmt.Fprintf(buf, "# temp_token_expires = %s\n", strconv.Quote(formatExpires(message.Expires)))
+	for _, line := range strings.Split(strings.TrimRight(message.CABundle, "\n"), "\n") {
+		if line != "" {
+			fmt.Fprintf(buf, "# ca_bundle: %s\n", line)
+		}
+	}
+	fmt.Fprint(buf, "\n")
+	fmt.Fprint(buf, "vault {\n")
+	fmt.Fprintf(buf, "  address = %s\n", strconv.Quote(message.VaultAddr))
+	fmt.Fprint(buf, "}\n\n")
+	fmt.Fprint(buf, "auto_auth {\n")
+	fmt.Fprint(buf, "  method \"token_file\" {\n")
+	fmt.Fprint(buf, "    config = {\n")
+	fmt.Fprint(buf, "      token_file_path = \"/tmp/vault-token\"\n")
+	fmt.Fprint(buf, "    }\n")
+	fmt.Fprint(buf, "  }\n\n")
+	fmt.Fprint(buf, "  sink \"file\" {\n")
+	fmt.Fprint(buf, "    config = {\n")
+	fmt.Fprint(buf, "      path = \"/tmp/vault-agent-token\"\n")
+	fmt.Fprint(buf, "    }\n")
+	fmt.Fprint(buf, "  }\n")
+	fmt.Fprint(buf, "}\n")
+	return buf.String(), nil
+}
+
+func formatExpires(expires time.Time) string {
+	if expires.IsZero() {
+		return ""
+	}
+	return expires.UTC().Format(time.RFC3339)
+}
+
+// shellQuote leaves plain values as they are, which keeps the historical
+// output for CUBBY_PATH and TEMP_TOKEN, and single quotes anything else.
+func shellQuote(value string) string {
+	if value != "" && strings.IndexFunc(value, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@%+,", r))
+	}) < 0 {
+		return value
+	}
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
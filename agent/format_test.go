@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatMessage(t *testing.T) {
+	message := &VaultResponseThing{
+		TempToken: "temp-token",
+		CubbyPath: "cubbyhole/abc",
+		VaultAddr: "https://vault:8200",
+		CABundle:  "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+		TTL:       300,
+		Expires:   time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: "shell",
+			want: "export CUBBY_PATH=cubbyhole/abc\n" +
+				"export TEMP_TOKEN=temp-token\n" +
+				"export VAULT_ADDR=https://vault:8200\n" +
+				"export VAULT_CA_BUNDLE='-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n'\n" +
+				"export TEMP_TOKEN_TTL=300\n" +
+				"export TEMP_TOKEN_EXPIRES=2017-03-01T12:00:00Z\n",
+		},
+		{
+			format: "dotenv",
+			want: "CUBBY_PATH=cubbyhole/abc\n" +
+				"TEMP_TOKEN=temp-token\n" +
+				"VAULT_ADDR=https://vault:8200\n" +
+				`VAULT_CA_BUNDLE="-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"` + "\n" +
+				"TEMP_TOKEN_TTL=300\n" +
+				"TEMP_TOKEN_EXPIRES=2017-03-01T12:00:00Z\n",
+		},
+		{
+			format: "yaml",
+			want: "cubbyPath: \"cubbyhole/abc\"\n" +
+				"tempToken: \"temp-token\"\n" +
+				"vaultAddr: \"https://vault:8200\"\n" +
+				"caBundle: |\n" +
+				"  -----BEGIN CERTIFICATE-----\n" +
+				"  MIIB\n" +
+				"  -----END CERTIFICATE-----\n" +
+				"ttl: 300\n" +
+				"expires: \"2017-03-01T12:00:00Z\"\n",
+		},
+	}
+
+	for _, test := range tests {
+		got, err := formatMessage(message, test.format)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.format, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.format, got, test.want)
+		}
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	message := &VaultResponseThing{
+		TempToken: "temp-token",
+		CubbyPath: "cubbyhole/abc",
+		VaultAddr: "https://vault:8200",
+		TTL:       300,
+	}
+
+	content, err := formatMessage(message, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &got); err != nil {
+		t.Fatalf("invalid json %q: %s", content, err)
+	}
+
+	for key, want := range map[string]interface{}{
+		"cubbyPath": "cubbyhole/abc",
+		"tempToken": "temp-token",
+		"vaultAddr": "https://vault:8200",
+		"caBundle":  "",
+		"ttl":       float64(300),
+		"expires":   "",
+	} {
+		if got[key] != want {
+			t.Errorf("%s is %v, want %v", key, got[key], want)
+		}
+	}
+}
+
+func TestFormatVaultAgent(t *testing.T) {
+	content, err := formatMessage(&VaultResponseThing{
+		TempToken: "temp-token",
+		CubbyPath: "cubbyhole/abc",
+		VaultAddr: "https://vault:8200",
+	}, "vault-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`# cubby_path = "cubbyhole/abc"`,
+		`# temp_token = "temp-token"`,
+		`address = "https://vault:8200"`,
+		`method "token_file"`,
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("expected %q in\n%s", want, content)
+		}
+	}
+}
+
+func TestFormatUnknown(t *testing.T) {
+	if _, err := formatMessage(&VaultResponseThing{}, "toml"); err == nil {
+		t.Error("expected an unknown format to be refused")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{"cubbyhole/abc-123_x.y:z", "cubbyhole/abc-123_x.y:z"},
+		{"", "''"},
+		{"two words", "'two words'"},
+		{"it's", `'it'\''s'`},
+		{"$(reboot)", "'$(reboot)'"},
+		{"a\nb", "'a\nb'"},
+	}
+
+	for _, test := range tests {
+		if got := shellQuote(test.value); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.value, got, test.want)
+		}
+	}
+}
@@ -12,33 +12,73 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/engine-api/types/events"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/secrets-bridge/types"
 	"github.com/rancher/secrets-bridge/writer"
 )
 
+const secretsPath = "/tmp"
+
 type VaultResponseThing struct {
 	ExternalId string
 	TempToken  string
 	CubbyPath  string
+	VaultAddr  string
+	CABundle   string
+	TTL        int
+	Expires    time.Time
 }
 
 type JsonHandler struct {
 	metadataCli           *metadata.Client
+	watcher               *metadataWatcher
 	remoteVerificationUrl string
+	heartbeatUrl          string
 	agentUUID             string
+	environment           string
 	signingKey            string
+	volumeDir             string
+	stateDir              string
+	deliverOnCreate       bool
+	runtime               Runtime
+	deliveries            *deliveryLog
+
+	mu              sync.Mutex
+	createDelivered map[string]bool
+}
+
+// deliveryError is a failed delivery, hook is set when only the notification failed.
+type deliveryError struct {
+	err        error
+	retryable  bool
+	retryAfter time.Duration
+	ttl        time.Duration
+	hook       bool
+}
+
+func (d *deliveryError) Error() string {
+	return d.err.Error()
 }
 
 type MessageHandler interface {
 	Handle(*events.Message) error
+	Issue(*events.Message) (*VaultResponseThing, error)
+	Release(*events.Message) error
+	Notify(*events.Message) error
+	Heartbeat(containerIDs []string) error
+	ManagedIP(containerID string) string
+	WantsSecrets(labels map[string]string) bool
 }
 
 func NewMessageHandler(opts map[string]interface{}) (MessageHandler, error) {
-	handler := &JsonHandler{}
+	handler := &JsonHandler{
+		createDelivered: map[string]bool{},
+	}
 
 	mdUrl, ok := opts["metadata-url"]
 	if !ok {
@@ -50,6 +90,7 @@ func NewMessageHandler(opts map[string]interface{}) (MessageHandler, error) {
 		return handler, err
 	}
 	handler.metadataCli = client
+	handler.watcher = newMetadataWatcher(client)
 
 	selfContainer, err := handler.metadataCli.GetSelfContainer()
 	if err != nil {
@@ -58,58 +99,220 @@ func NewMessageHandler(opts map[string]interface{}) (MessageHandler, error) {
 
 	handler.agentUUID = selfContainer.UUID
 
+	if env, ok := opts["environment"]; ok && env.(string) != "" {
+		handler.environment = env.(string)
+	} else {
+		selfStack, err := handler.metadataCli.GetSelfStack()
+		if err != nil {
+			return handler, err
+		}
+		handler.environment = selfStack.EnvironmentName
+	}
+	logrus.Debugf("Agent environment: %s", handler.environment)
+
 	rsUrl, ok := opts["bridge-url"]
 	if !ok || rsUrl.(string) == "" {
 		return handler, errors.New("No bridge URL defined")
 	}
 
-	handler.signingKey = os.Getenv("CATTLE_SECRET_KEY")
+	handler.signingKey, _ = agentSigningKey()
 	if handler.signingKey == "" {
 		return handler, errors.New("No signing key available.")
 	}
 
 	handler.remoteVerificationUrl = rsUrl.(string)
 
+	if hbUrl, ok := opts["heartbeat-url"].(string); ok {
+		handler.heartbeatUrl = hbUrl
+	}
+
+	runtime, ok := opts["runtime"].(Runtime)
+	if !ok {
+		return handler, errors.New("No container runtime defined")
+	}
+	handler.runtime = runtime
+
+	if volumeDir, ok := opts["volume-dir"].(string); ok {
+		handler.volumeDir = volumeDir
+	}
+
+	if deliverOnCreate, ok := opts["deliver-on-create"].(bool); ok {
+		handler.deliverOnCreate = deliverOnCreate
+	}
+
+	if stateDir, ok := opts["state-dir"].(string); ok {
+		handler.stateDir = stateDir
+	}
+
+	if deliveries, ok := opts["deliveries"].(*deliveryLog); ok {
+		handler.deliveries = deliveries
+	} else {
+		handler.deliveries = newDeliveryLog("")
+	}
+
 	return handler, nil
 }
 
 func (j *JsonHandler) Handle(msg *events.Message) error {
-	message, err := j.buildRequestMessage(msg)
+	if msg.Action == "start" && j.takeCreateDelivery(msg.ID) {
+		logrus.Debugf("Container %s got credentials when it was created", msg.ID)
+		return nil
+	}
+
+	deliveryOpts, err := parseDeliveryOptions(msg.Actor.Attributes)
 	if err != nil {
 		return err
 	}
 
-	jMsg, err := json.Marshal(message)
+	if msg.Action == "create" {
+		if deliveryOpts.Writer == writer.VolumeWriterType && wantsSecrets(msg.Actor.Attributes) {
+			if err := j.prepareVolume(msg.ID, deliveryOpts); err != nil {
+				return err
+			}
+		}
+		if !j.deliverOnCreate {
+			return nil
+		}
+	}
+
+	vaultThing, err := j.Issue(msg)
 	if err != nil {
 		return err
 	}
 
-	b := bytes.NewBuffer(jMsg)
+	err = j.writeResponse(vaultThing, deliveryOpts)
+	if err != nil {
+		logrus.Errorf("Error: writing response to %s", vaultThing.ExternalId)
+		logrus.Error(err)
+		// the container may not be ready to be written to yet, the next
+		// attempt asks the bridge for new credentials
+		return &deliveryError{err: err, retryable: true, ttl: time.Duration(vaultThing.TTL) * time.Second}
+	}
+
+	j.deliveries.Record(msg.ID)
+
+	// nothing is running to notify before the container starts
+	if msg.Action == "create" {
+		j.mu.Lock()
+		j.createDelivered[msg.ID] = true
+		j.mu.Unlock()
+		return nil
+	}
 
-	resp, err := j.postRequestToSecretBridge(b)
+	if err := notify(j.runtime, vaultThing.ExternalId, deliveryOpts); err != nil {
+		return &deliveryError{err: err, retryable: true, hook: true, ttl: time.Duration(vaultThing.TTL) * time.Second}
+	}
+
+	return nil
+}
+
+// Notify retries the hook of a container that has its credentials.
+func (j *JsonHandler) Notify(msg *events.Message) error {
+	deliveryOpts, err := parseDeliveryOptions(msg.Actor.Attributes)
 	if err != nil {
 		return err
 	}
+
+	if err := notify(j.runtime, msg.ID, deliveryOpts); err != nil {
+		return &deliveryError{err: err, retryable: true, hook: true}
+	}
+
+	return nil
+}
+
+// takeCreateDelivery reports whether the container was already handed
+// credentials on create, so its first start doesn't issue a second set.
+func (j *JsonHandler) takeCreateDelivery(containerID string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.createDelivered[containerID] {
+		delete(j.createDelivered, containerID)
+		return true
+	}
+	return false
+}
+
+// Issue asks the bridge for credentials for the container in msg.
+func (j *JsonHandler) Issue(msg *events.Message) (*VaultResponseThing, error) {
+	message, err := j.buildRequestMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	jMsg, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	b := bytes.NewBuffer(jMsg)
+
+	resp, err := j.postRequestToSecretBridge(j.remoteVerificationUrl, b)
+	if err != nil {
+		return nil, &deliveryError{err: err, retryable: true}
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 201 {
-		return fmt.Errorf("Didn't get created response, got: %d", resp.StatusCode)
+		return nil, &deliveryError{
+			err:        fmt.Errorf("Didn't get created response, got: %d", resp.StatusCode),
+			retryable:  retryableStatus(resp.StatusCode),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
 
-	var vaultThing VaultResponseThing
+	vaultThing := &VaultResponseThing{}
 	decoder := json.NewDecoder(resp.Body)
-	decoder.Decode(&vaultThing)
+	if err := decoder.Decode(vaultThing); err != nil {
+		return nil, err
+	}
 
 	logrus.Debugf("Got Response: %#v", vaultThing)
 
-	err = writeResponse(&vaultThing)
-	if err != nil {
-		logrus.Errorf("Error: writing response to %s", vaultThing.ExternalId)
-		logrus.Error(err)
-		return err
+	return vaultThing, nil
+}
+
+// ManagedIP is the container's IP on Rancher's managed network, which
+// Docker doesn't know about.
+func (j *JsonHandler) ManagedIP(containerID string) string {
+	return j.watcher.PrimaryIP(containerID)
+}
+
+// WantsSecrets checks a running container's labels, and those of its pod
+// in metadata, without waiting for metadata to catch up.
+func (j *JsonHandler) WantsSecrets(labels map[string]string) bool {
+	if labels["secrets.bridge.enabled"] == "true" {
+		return true
 	}
+	if _, ok := labels["io.kubernetes.pod.namespace"]; !ok {
+		return false
+	}
+	return labels["io.kubernetes.container.name"] != "POD" && j.checkPod(labels, 0) == nil
+}
 
-	return nil
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := http.ParseTime(value); err == nil {
+		return when.Sub(time.Now())
+	}
+
+	return 0
 }
 
 func (j *JsonHandler) buildRequestMessage(msg *events.Message) (*ContainerEventMessage, error) {
@@ -126,8 +329,8 @@ func (j *JsonHandler) buildRequestMessage(msg *events.Message) (*ContainerEventM
 			return message, errors.New("Ignoring K8s POD container")
 		}
 
-		if !j.checkForK8sSecretsLabel(msg) {
-			return message, errors.New("Secrets bridge label not found")
+		if err := j.checkK8sPod(msg); err != nil {
+			return message, err
 		}
 		message.ContainerType = "kubernetes"
 	}
@@ -140,8 +343,13 @@ func (j *JsonHandler) buildRequestMessage(msg *events.Message) (*ContainerEventM
 
 	message.Event = msg
 	message.Action = msg.Action
+	message.Phase = msg.Action
+	message.Environment = j.environment
+	// a container started again after a delivery has been restarted, its
+	// files may be gone and the bridge may want to revoke its old token
+	message.Restart = msg.Action == "start" && j.deliveries.Has(msg.ID)
 
-	err := message.SetUUIDFromMetadata(j.metadataCli)
+	err := message.SetUUIDFromMetadata(j.watcher)
 	if err != nil {
 		return message, err
 	}
@@ -156,7 +364,15 @@ func (j *JsonHandler) buildRequestMessage(msg *events.Message) (*ContainerEventM
 	return message, nil
 }
 
-func (j *JsonHandler) generateSignatureHeader() string {
+// agentSigningKey returns the signing key and the variable it came from.
+func agentSigningKey() (string, string) {
+	if key := os.Getenv("SECRETS_BRIDGE_SIGNING_KEY"); key != "" {
+		return key, "SECRETS_BRIDGE_SIGNING_KEY"
+	}
+	return os.Getenv("CATTLE_SECRET_KEY"), "CATTLE_SECRET_KEY"
+}
+
+func (j *JsonHandler) generateSignatureHeader(method, path string, body []byte) string {
 	mac := hmac.New(sha256.New, []byte(j.signingKey))
 
 	logrus.Debugf("UUID: %s", j.agentUUID)
@@ -164,7 +380,7 @@ func (j *JsonHandler) generateSignatureHeader() string {
 	ts := strconv.FormatInt(time.Now().Unix(), 10)
 	logrus.Debugf("Time: %s", ts)
 
-	mac.Write([]byte(j.agentUUID + ts))
+	mac.Write(types.SignaturePayload(j.agentUUID, ts, method, path, body))
 	hmacMessage := string(mac.Sum(nil)[:mac.Size()])
 	logrus.Debugf("hmac: %x", hmacMessage)
 
@@ -174,32 +390,43 @@ func (j *JsonHandler) generateSignatureHeader() string {
 	return base64.StdEncoding.EncodeToString([]byte(message))
 }
 
-func (j *JsonHandler) postRequestToSecretBridge(buffer *bytes.Buffer) (*http.Response, error) {
+func (j *JsonHandler) postRequestToSecretBridge(url string, buffer *bytes.Buffer) (*http.Response, error) {
 	client := &http.Client{}
-	req, err := http.NewRequest("POST", j.remoteVerificationUrl, buffer)
+	body := buffer.Bytes()
+	req, err := http.NewRequest("POST", url, buffer)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("X-Agent-Signature", j.generateSignatureHeader())
+	req.Header.Add("X-Agent-Signature", j.generateSignatureHeader(req.Method, req.URL.Path, body))
 
 	return client.Do(req)
 }
 
-func writeResponse(message *VaultResponseThing) error {
-	cli, err := getDockerClient()
+func (j *JsonHandler) writeResponse(message *VaultResponseThing, deliveryOpts *deliveryOptions) error {
+	if err := deliveryOpts.resolveOwner(j.runtime, message.ExternalId); err != nil {
+		return err
+	}
+
+	content, err := formatMessage(message, deliveryOpts.Format)
 	if err != nil {
-		logrus.Fatal(err)
+		return err
 	}
 
 	opts := map[string]interface{}{
-		"dockerClient": cli,
-		"message":      formatMessage(message),
-		"path":         "/tmp",
-		"containerId":  message.ExternalId,
+		"writer":    deliveryOpts.Writer,
+		"message":   content,
+		"path":      deliveryOpts.Path,
+		"filename":  deliveryOpts.Filename,
+		"mode":      deliveryOpts.Mode,
+		"uid":       deliveryOpts.Uid,
+		"gid":       deliveryOpts.Gid,
+		"volumeDir": j.volumeDir,
+		"stateDir":  j.stateDir,
+		"command":   deliveryOpts.Command,
 	}
 
-	writer, err := writer.NewSecretWriter(opts)
+	writer, err := j.runtime.NewWriter(message.ExternalId, opts)
 	if err != nil {
 		return err
 	}
@@ -207,42 +434,86 @@ func writeResponse(message *VaultResponseThing) error {
 	return writer.Write()
 }
 
-func formatMessage(message *VaultResponseThing) string {
-	return fmt.Sprintf("export CUBBY_PATH=%s\nexport TEMP_TOKEN=%s\n", message.CubbyPath, message.TempToken)
+// prepareVolume creates the directory of a volume writer container when it
+// is created, before Docker makes one for the mount.
+func (j *JsonHandler) prepareVolume(containerID string, deliveryOpts *deliveryOptions) error {
+	if err := deliveryOpts.resolveOwner(j.runtime, containerID); err != nil {
+		return err
+	}
+
+	w, err := j.runtime.NewWriter(containerID, map[string]interface{}{
+		"writer":    deliveryOpts.Writer,
+		"message":   "",
+		"path":      deliveryOpts.Path,
+		"uid":       deliveryOpts.Uid,
+		"gid":       deliveryOpts.Gid,
+		"volumeDir": j.volumeDir,
+		"stateDir":  j.stateDir,
+	})
+	if err != nil {
+		return err
+	}
+
+	if volume, ok := w.(*writer.VolumeWriter); ok {
+		_, err = volume.Prepare()
+	}
+	return err
 }
 
-func (j *JsonHandler) checkForK8sSecretsLabel(msg *events.Message) bool {
-	enabled := false
-	labelExists := false
-	labelValue := "notavailable"
+// checkK8sPod makes sure the container's pod, once it is in metadata, wants credentials in it.
+func (j *JsonHandler) checkK8sPod(msg *events.Message) error {
+	wait := metadataWait
+	if msg.Action == "create" {
+		wait = 0
+	}
 
-	maxWait := 129 * time.Second
+	err := j.checkPod(msg.Actor.Attributes, wait)
+	if err == errNotInMetadata {
+		if msg.Action == "create" {
+			return errNeedsStart
+		}
+		return errors.New("Secrets bridge label not found")
+	}
+	return err
+}
 
-	name := msg.Actor.Attributes["io.kubernetes.pod.name"]
-	nameSpace := msg.Actor.Attributes["io.kubernetes.pod.namespace"]
+// checkPod looks the container's pod up in metadata, waiting up to wait for
+// it to show up.
+func (j *JsonHandler) checkPod(labels map[string]string, wait time.Duration) error {
+	name := labels["io.kubernetes.pod.name"]
+	nameSpace := labels["io.kubernetes.pod.namespace"]
+	containerName := labels["io.kubernetes.container.name"]
 
 	logrus.Debugf("Pod Name: %s", name)
-	logrus.Debugf("Pod Namespace: %s", name)
+	logrus.Debugf("Pod Namespace: %s", nameSpace)
 
-	container := metadata.Container{}
-	for i := 1 * time.Second; i < maxWait; i *= time.Duration(2) {
-		containers, err := j.metadataCli.GetContainers()
-		if err != nil {
-			logrus.Error(err)
-			return false
-		}
-		container = loopContainers(name, "io.kubernetes.pod.namespace", nameSpace, containers)
-		if labelValue, labelExists = container.Labels["secrets.bridge.enabled"]; labelExists {
-			break
-		}
-		time.Sleep(i)
+	pod, err := j.watcher.FindPod(nameSpace, name, func(c metadata.Container) bool {
+		_, ok := c.Labels["secrets.bridge.enabled"]
+		return ok
+	}, wait)
+	if err != nil {
+		logrus.Debugf("Pod %s/%s: %s", nameSpace, name, err)
+		return err
 	}
 
-	logrus.Debugf("Labels found: %#v", container.Labels)
+	logrus.Debugf("Labels found: %#v", pod.Labels)
 
-	if labelValue == "true" {
-		enabled = true
+	if pod.Labels["secrets.bridge.enabled"] != "true" {
+		return errors.New("Secrets bridge not enabled")
 	}
 
-	return enabled
+	if selected := pod.Labels[podContainersLabel]; selected != "" && !listContains(selected, containerName) {
+		return fmt.Errorf("Container %s is not in %s of pod %s/%s", containerName, podContainersLabel, nameSpace, name)
+	}
+
+	return nil
+}
+
+func listContains(list, value string) bool {
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == value {
+			return true
+		}
+	}
+	return false
 }
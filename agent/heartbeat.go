@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types/events"
+	"github.com/rancher/secrets-bridge/types"
+)
+
+// runHeartbeat reports the running containers to the bridge every
+// interval until stop is closed, so it keeps renewing their tokens.
+func runHeartbeat(runtime Runtime, handler MessageHandler, interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ids, err := runtime.Running()
+		if err != nil {
+			logrus.Warnf("Heartbeat: could not list containers: %s", err)
+		} else if err := handler.Heartbeat(ids); err != nil {
+			logrus.Warnf("Heartbeat: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Heartbeat tells the bridge which containers run on this host.
+func (j *JsonHandler) Heartbeat(containerIDs []string) error {
+	if j.heartbeatUrl == "" {
+		return nil
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	return j.post(j.heartbeatUrl, &types.Heartbeat{
+		Host:        host,
+		Environment: j.environment,
+		Containers:  containerIDs,
+	})
+}
+
+// Release tells the bridge a container that may have had credentials was
+// destroyed, so its token can be revoked.
+func (j *JsonHandler) Release(msg *events.Message) error {
+	if !wantsSecrets(msg.Actor.Attributes) {
+		return nil
+	}
+
+	message := &ContainerEventMessage{
+		Event:         msg,
+		Action:        msg.Action,
+		Phase:         msg.Action,
+		Environment:   j.environment,
+		ContainerType: "cattle",
+	}
+	if _, ok := msg.Actor.Attributes["io.kubernetes.pod.namespace"]; ok {
+		message.ContainerType = "kubernetes"
+	}
+
+	var err error
+	message.Host, err = os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	return j.post(j.remoteVerificationUrl, message)
+}
+
+func (j *JsonHandler) post(url string, body interface{}) error {
+	jMsg, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := j.postRequestToSecretBridge(url, bytes.NewBuffer(jMsg))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Bridge responded with: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var hookMetrics = expvar.NewMap("deliveryHooks")
+
+// notify lets the application know its credentials were delivered, by
+// signalling the container's PID 1 or running its reload command.
+func notify(runtime Runtime, containerID string, deliveryOpts *deliveryOptions) error {
+	var kind, description string
+	var err error
+
+	switch {
+	case deliveryOpts.Signal != "":
+		kind = "signal"
+		description = deliveryOpts.Signal
+		err = runtime.Signal(containerID, deliveryOpts.Signal)
+	case len(deliveryOpts.Reload) > 0:
+		kind = "reload"
+		description = strings.Join(deliveryOpts.Reload, " ")
+		user := fmt.Sprintf("%d:%d", deliveryOpts.Uid, deliveryOpts.Gid)
+		err = runtime.Exec(containerID, user, deliveryOpts.Reload, "")
+	default:
+		return nil
+	}
+
+	if err != nil {
+		hookMetrics.Add(kind+".failures", 1)
+		logrus.Errorf("Hook %s %s for container %s failed: %s", kind, description, containerID, err)
+		return fmt.Errorf("Hook %s failed: %s", kind, err)
+	}
+
+	hookMetrics.Add(kind+".successes", 1)
+	logrus.Infof("Hook %s %s for container %s succeeded", kind, description, containerID)
+	return nil
+}
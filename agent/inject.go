@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types/events"
+	"github.com/rancher/secrets-bridge/writer"
+	"github.com/urfave/cli"
+)
+
+// InjectContainer issues credentials to one container and delivers them
+// the way a start event would, e.g. to retry a failed delivery by hand.
+func InjectContainer(c *cli.Context) {
+	if c.NArg() != 1 {
+		logrus.Fatal("Usage: secrets-bridge agent inject [options] <container-id>")
+	}
+
+	runtime, err := newRuntime(c)
+	if err != nil {
+		logrus.Fatalf("Could not get container runtime: %s", err)
+	}
+
+	info, err := runtime.Inspect(c.Args().First())
+	if err != nil {
+		logrus.Fatalf("Could not inspect container: %s", err)
+	}
+
+	msg := containerMessage(info)
+
+	deliveryOpts, err := parseDeliveryOptions(msg.Actor.Attributes)
+	if err != nil {
+		logrus.Fatalf("Invalid delivery options: %s", err)
+	}
+
+	handler, err := newHandler(c, runtime, newDeliveryLog(c.String("state-dir")))
+	if err != nil {
+		logrus.Fatalf("Error: %s", err)
+	}
+
+	if c.Bool("dry-run") {
+		message, err := handler.(*JsonHandler).buildRequestMessage(msg)
+		if err != nil {
+			logrus.Fatalf("Container %s would not get credentials: %s", info.ID, err)
+		}
+
+		content, err := json.MarshalIndent(message, "", "  ")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		fmt.Printf("Message:\n%s\n", content)
+		fmt.Printf("Target: %s\n", deliveryTarget(deliveryOpts, c.String("volume-dir")))
+		fmt.Printf("Format: %s\n", deliveryOpts.Format)
+		return
+	}
+
+	if err := handler.Handle(msg); err != nil {
+		logrus.Fatalf("Could not deliver credentials to %s: %s", info.ID, err)
+	}
+
+	logrus.Infof("Delivered credentials to %s", deliveryTarget(deliveryOpts, c.String("volume-dir")))
+}
+
+// containerMessage dresses a container up as the start event the handler
+// would have received.
+func containerMessage(info *ContainerInfo) *events.Message {
+	attributes := map[string]string{}
+	for key, value := range info.Labels {
+		attributes[key] = value
+	}
+	attributes["name"] = info.Name
+	attributes["image"] = info.Image
+
+	return &events.Message{
+		Status: "start",
+		ID:     info.ID,
+		From:   info.Image,
+		Type:   "container",
+		Action: "start",
+		Actor: events.Actor{
+			ID:         info.ID,
+			Attributes: attributes,
+		},
+	}
+}
+
+func deliveryTarget(deliveryOpts *deliveryOptions, volumeDir string) string {
+	target := ""
+	switch deliveryOpts.Writer {
+	case writer.ExecWriterType:
+		target = "stdin of " + strings.Join(deliveryOpts.Command, " ")
+	case writer.VolumeWriterType:
+		target = fmt.Sprintf("%s in the volume under %s mounted at %s", deliveryOpts.Filename, volumeDir, deliveryOpts.Path)
+	default:
+		target = path.Join(deliveryOpts.Path, deliveryOpts.Filename)
+	}
+
+	switch {
+	case deliveryOpts.Signal != "":
+		target += ", then " + deliveryOpts.Signal
+	case len(deliveryOpts.Reload) > 0:
+		target += ", then " + strings.Join(deliveryOpts.Reload, " ")
+	}
+
+	return target
+}
@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"golang.org/x/net/context"
+)
+
+var errCallerUnknown = errors.New("Could not map caller to a container")
+
+// localIssueInterval is how often a container can have credentials issued.
+const localIssueInterval = 10 * time.Second
+
+// localAPI issues new credentials to the containers on this host that ask for them.
+type localAPI struct {
+	dockerClient *client.Client
+	handler      MessageHandler
+
+	mu        sync.Mutex
+	lastIssue map[string]time.Time
+}
+
+// serveLocalAPI listens on a unix:// path or a host:port address.
+func serveLocalAPI(listen string, dockerClient *client.Client, handler MessageHandler) error {
+	api := &localAPI{
+		dockerClient: dockerClient,
+		handler:      handler,
+		lastIssue:    map[string]time.Time{},
+	}
+
+	var listener net.Listener
+	var err error
+
+	if strings.HasPrefix(listen, "unix://") {
+		path := strings.TrimPrefix(listen, "unix://")
+		os.Remove(path)
+
+		listener, err = listenUnixWithPeerCred(path)
+		if err != nil {
+			return err
+		}
+
+		// every container the socket is mounted into must be able to connect
+		if err := os.Chmod(path, 0666); err != nil {
+			return err
+		}
+	} else {
+		listener, err = net.Listen("tcp", listen)
+		if err != nil {
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/credentials", api.credentialsHandler)
+
+	logrus.Infof("Serving local credential API on: %s", listen)
+	return http.Serve(listener, mux)
+}
+
+func (api *localAPI) credentialsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = defaultFormat
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			format = "json"
+		}
+	}
+
+	if !validFormat(format) {
+		http.Error(w, "Unknown format: "+format, http.StatusBadRequest)
+		return
+	}
+
+	container, err := api.identifyCaller(r.RemoteAddr)
+	if err != nil {
+		logrus.Warnf("Local API: %s (%s)", err, r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if !api.handler.WantsSecrets(container.Labels) {
+		http.Error(w, "Secrets bridge not enabled", http.StatusForbidden)
+		return
+	}
+
+	if !api.takeIssue(container.ID) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(localIssueInterval/time.Second)))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	logrus.Debugf("Local API: issuing credentials to container %s", container.ID)
+	vaultThing, err := api.handler.Issue(startMessage(*container))
+	if err != nil {
+		logrus.Errorf("Local API: could not issue credentials to %s: %s", container.ID, err)
+		if dErr, ok := err.(*deliveryError); ok && dErr.retryable {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	content, err := formatMessage(vaultThing, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain;charset=UTF-8")
+	}
+	fmt.Fprint(w, content)
+}
+
+// takeIssue reports whether the container may have credentials issued now.
+func (api *localAPI) takeIssue(containerID string) bool {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	now := time.Now()
+	for id, last := range api.lastIssue {
+		if now.Sub(last) >= localIssueInterval {
+			delete(api.lastIssue, id)
+		}
+	}
+
+	if _, ok := api.lastIssue[containerID]; ok {
+		return false
+	}
+	api.lastIssue[containerID] = now
+	return true
+}
+
+func (api *localAPI) identifyCaller(remoteAddr string) (*types.Container, error) {
+	if strings.HasPrefix(remoteAddr, peerPidPrefix) {
+		pid, err := strconv.Atoi(strings.TrimPrefix(remoteAddr, peerPidPrefix))
+		if err != nil {
+			return nil, err
+		}
+
+		containerID, err := containerIDFromPid(pid)
+		if err != nil {
+			return nil, err
+		}
+
+		return api.findContainer(func(c *types.Container) bool {
+			return c.ID == containerID
+		})
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.findContainer(func(c *types.Container) bool {
+		return api.handler.ManagedIP(c.ID) == host || containerHasIP(c, host)
+	})
+}
+
+func (api *localAPI) findContainer(match func(*types.Container) bool) (*types.Container, error) {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("status", "running")
+
+	containers, err := api.dockerClient.ContainerList(context.Background(), types.ContainerListOptions{
+		Filter: filterArgs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range containers {
+		if match(&containers[i]) {
+			return &containers[i], nil
+		}
+	}
+
+	return nil, errCallerUnknown
+}
+
+// containerHasIP checks the container's Docker networks, labels are set by
+// whoever created the container and can't be trusted for this.
+func containerHasIP(container *types.Container, ip string) bool {
+	if container.NetworkSettings == nil {
+		return false
+	}
+
+	for _, endpoint := range container.NetworkSettings.Networks {
+		if endpoint != nil && endpoint.IPAddress == ip {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,23 +1,29 @@
 package agent
 
 import (
+	"errors"
 	"strings"
-	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/engine-api/types/events"
-	"github.com/rancher/go-rancher-metadata/metadata"
 )
 
+// errNeedsStart is returned for a created container that can't be
+// verified until it is running. Its start event will deliver instead.
+var errNeedsStart = errors.New("Container can only be verified once started")
+
 type ContainerEventMessage struct {
 	Event         *events.Message
 	UUID          string `json:"UUID"`
 	Action        string `json:"Action"`
 	Host          string `json:"Host"`
+	Environment   string `json:"Environment"`
+	Phase         string `json:"phase"`
+	Restart       bool   `json:"restart,omitempty"`
 	ContainerType string `json:"container_type"`
 }
 
-func (cem *ContainerEventMessage) SetUUIDFromMetadata(mdCli *metadata.Client) error {
+func (cem *ContainerEventMessage) SetUUIDFromMetadata(watcher *metadataWatcher) error {
 	nameKey := "name"
 	verifyKey := "io.rancher.container.uuid"
 
@@ -39,14 +45,18 @@ func (cem *ContainerEventMessage) SetUUIDFromMetadata(mdCli *metadata.Client) er
 
 	logrus.Debugf("Using: %s as a container name", name)
 
-	container := metadata.Container{}
-	for len(container.Labels) == 0 {
-		containers, err := mdCli.GetContainers()
-		if err != nil {
-			return err
-		}
-		container = loopContainers(name, verifyKey, cem.Event.Actor.Attributes[verifyKey], containers)
-		time.Sleep(100 * time.Millisecond)
+	// a created container is only in metadata if Rancher created it
+	wait := metadataWait
+	if cem.Phase == "create" {
+		wait = 0
+	}
+
+	container, err := watcher.FindContainer(name, verifyKey, cem.Event.Actor.Attributes[verifyKey], wait)
+	if err == errNotInMetadata && cem.Phase == "create" {
+		return errNeedsStart
+	}
+	if err != nil {
+		return err
 	}
 
 	logrus.Debugf("UUID: %s found", container.UUID)
@@ -54,18 +64,3 @@ func (cem *ContainerEventMessage) SetUUIDFromMetadata(mdCli *metadata.Client) er
 
 	return nil
 }
-
-func loopContainers(name, vKey, expectedVKeyValue string, containers []metadata.Container) metadata.Container {
-	for _, container := range containers {
-		if container.Name == name {
-			if value, ok := container.Labels[vKey]; ok {
-				if value == expectedVKeyValue {
-					return container
-				}
-			}
-		}
-	}
-
-	return metadata.Container{}
-
-}
@@ -0,0 +1,282 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/secrets-bridge/writer"
+)
+
+const (
+	pathLabel     = "secrets.bridge.path"
+	filenameLabel = "secrets.bridge.filename"
+	formatLabel   = "secrets.bridge.format"
+	uidLabel      = "secrets.bridge.uid"
+	gidLabel      = "secrets.bridge.gid"
+	modeLabel     = "secrets.bridge.mode"
+	writerLabel   = "secrets.bridge.writer"
+	execLabel     = "secrets.bridge.exec"
+	signalLabel   = "secrets.bridge.signal"
+	reloadLabel   = "secrets.bridge.reload"
+
+	// podContainersLabel is a pod label naming the containers of the pod
+	// that get credentials, all of them when it isn't set.
+	podContainersLabel = "secrets.bridge.containers"
+
+	defaultFormat = "shell"
+)
+
+// deliveryOptions say where and how the secret file lands in a container.
+// Uid and Gid are -1 until set by a label or the container's user.
+type deliveryOptions struct {
+	Path     string
+	Filename string
+	Format   string
+	Uid      int
+	Gid      int
+	Mode     int64
+	Writer   string
+	Command  []string
+	Signal   string
+	Reload   []string
+}
+
+func parseDeliveryOptions(labels map[string]string) (*deliveryOptions, error) {
+	opts := &deliveryOptions{
+		Path:     secretsPath,
+		Filename: writer.SecretsFileName,
+		Format:   defaultFormat,
+		Uid:      -1,
+		Gid:      -1,
+		Mode:     0600,
+		Writer:   writer.ContainerFSWriterType,
+	}
+
+	if value, ok := labels[pathLabel]; ok {
+		if !path.IsAbs(value) {
+			return nil, fmt.Errorf("%s must be an absolute path: %s", pathLabel, value)
+		}
+		if hasParentSegment(value) {
+			return nil, fmt.Errorf("%s must not contain '..': %s", pathLabel, value)
+		}
+		opts.Path = path.Clean(value)
+	}
+
+	if value, ok := labels[filenameLabel]; ok {
+		if value == "" || value == "." || value == ".." || strings.Contains(value, "/") {
+			return nil, fmt.Errorf("%s must be a plain file name: %s", filenameLabel, value)
+		}
+		opts.Filename = value
+	}
+
+	if value, ok := labels[formatLabel]; ok {
+		if !validFormat(value) {
+			return nil, fmt.Errorf("%s is not a known format: %s", formatLabel, value)
+		}
+		opts.Format = value
+	}
+
+	if value, ok := labels[uidLabel]; ok {
+		uid, err := parseID(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", uidLabel, err)
+		}
+		opts.Uid = uid
+	}
+
+	if value, ok := labels[gidLabel]; ok {
+		gid, err := parseID(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", gidLabel, err)
+		}
+		opts.Gid = gid
+	}
+
+	if value, ok := labels[modeLabel]; ok {
+		mode, err := strconv.ParseInt(value, 8, 64)
+		if err != nil || mode < 0 || mode > 0777 {
+			return nil, fmt.Errorf("%s must be an octal file mode: %s", modeLabel, value)
+		}
+		opts.Mode = mode
+	}
+
+	if value, ok := labels[writerLabel]; ok {
+		if value != writer.ContainerFSWriterType && value != writer.VolumeWriterType {
+			return nil, fmt.Errorf("%s must be %s or %s: %s", writerLabel, writer.ContainerFSWriterType, writer.VolumeWriterType, value)
+		}
+		opts.Writer = value
+	}
+
+	if value, ok := labels[execLabel]; ok {
+		if _, ok := labels[writerLabel]; ok {
+			return nil, fmt.Errorf("%s can not be combined with %s", execLabel, writerLabel)
+		}
+		opts.Command = strings.Fields(value)
+		if len(opts.Command) == 0 {
+			return nil, fmt.Errorf("%s must name a command", execLabel)
+		}
+		opts.Writer = writer.ExecWriterType
+	}
+
+	if value, ok := labels[signalLabel]; ok {
+		if _, ok := labels[reloadLabel]; ok {
+			return nil, fmt.Errorf("%s can not be combined with %s", signalLabel, reloadLabel)
+		}
+		signal, err := parseSignal(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", signalLabel, err)
+		}
+		opts.Signal = signal
+	}
+
+	if value, ok := labels[reloadLabel]; ok {
+		opts.Reload = strings.Fields(value)
+		if len(opts.Reload) == 0 {
+			return nil, fmt.Errorf("%s must name a command", reloadLabel)
+		}
+	}
+
+	return opts, nil
+}
+
+func (o *deliveryOptions) FilePath() string {
+	return path.Join(o.Path, o.Filename)
+}
+
+// resolveOwner fills in the owner not set by labels from the user the
+// container runs as, so non-root processes can read their file.
+func (o *deliveryOptions) resolveOwner(runtime Runtime, containerID string) error {
+	if o.Uid >= 0 && o.Gid >= 0 {
+		return nil
+	}
+
+	info, err := runtime.Inspect(containerID)
+	if err != nil {
+		return err
+	}
+
+	uid, gid, err := lookupUser(runtime, containerID, info.User)
+	if err != nil {
+		return err
+	}
+
+	if o.Uid < 0 {
+		o.Uid = uid
+	}
+	if o.Gid < 0 {
+		o.Gid = gid
+	}
+
+	return nil
+}
+
+// lookupUser turns a Docker USER value into ids. Names are looked up in
+// the container's /etc/passwd and /etc/group.
+func lookupUser(runtime Runtime, containerID, user string) (int, int, error) {
+	if user == "" {
+		return 0, 0, nil
+	}
+
+	userPart := user
+	groupPart := ""
+	if i := strings.Index(user, ":"); i >= 0 {
+		userPart = user[:i]
+		groupPart = user[i+1:]
+	}
+
+	// a numeric user keeps Docker's default group of root
+	uid, err := strconv.Atoi(userPart)
+	gid := 0
+	if err != nil {
+		entry, err := lookupEntry(runtime, containerID, "/etc/passwd", userPart)
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(entry) < 4 {
+			return 0, 0, fmt.Errorf("Malformed /etc/passwd entry for %s", userPart)
+		}
+		if uid, err = strconv.Atoi(entry[2]); err != nil {
+			return 0, 0, err
+		}
+		if gid, err = strconv.Atoi(entry[3]); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if groupPart != "" {
+		if gid, err = strconv.Atoi(groupPart); err != nil {
+			entry, err := lookupEntry(runtime, containerID, "/etc/group", groupPart)
+			if err != nil {
+				return 0, 0, err
+			}
+			if len(entry) < 3 {
+				return 0, 0, fmt.Errorf("Malformed /etc/group entry for %s", groupPart)
+			}
+			if gid, err = strconv.Atoi(entry[2]); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	return uid, gid, nil
+}
+
+func lookupEntry(runtime Runtime, containerID, file, name string) ([]string, error) {
+	content, err := runtime.ReadFile(containerID, file)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if fields[0] == name {
+			return fields, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("%s not found in %s of container %s", name, file, containerID)
+}
+
+func parseID(value string) (int, error) {
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("must be a non-negative number: %s", value)
+	}
+	return id, nil
+}
+
+// parseSignal accepts a signal name, with or without SIG, or number in the
+// form Docker's kill API takes it.
+func parseSignal(value string) (string, error) {
+	signal := strings.TrimPrefix(strings.ToUpper(value), "SIG")
+	if signal == "" {
+		return "", fmt.Errorf("must be a signal name or number: %s", value)
+	}
+	for _, r := range signal {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '+' || r == '-') {
+			return "", fmt.Errorf("must be a signal name or number: %s", value)
+		}
+	}
+	if _, err := strconv.Atoi(signal); err == nil {
+		return signal, nil
+	}
+	return "SIG" + signal, nil
+}
+
+func hasParentSegment(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
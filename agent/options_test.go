@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/secrets-bridge/writer"
+)
+
+func TestParseDeliveryOptions(t *testing.T) {
+	defaults := deliveryOptions{
+		Path:     secretsPath,
+		Filename: writer.SecretsFileName,
+		Format:   defaultFormat,
+		Uid:      -1,
+		Gid:      -1,
+		Mode:     0600,
+		Writer:   writer.ContainerFSWriterType,
+	}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		change func(*deliveryOptions)
+		err    bool
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name:   "path",
+			labels: map[string]string{pathLabel: "/run/secrets/"},
+			change: func(o *deliveryOptions) { o.Path = "/run/secrets" },
+		},
+		{
+			name:   "relative path",
+			labels: map[string]string{pathLabel: "run/secrets"},
+			err:    true,
+		},
+		{
+			name:   "path with a parent",
+			labels: map[string]string{pathLabel: "/run/../etc"},
+			err:    true,
+		},
+		{
+			name:   "filename",
+			labels: map[string]string{filenameLabel: "vault.env"},
+			change: func(o *deliveryOptions) { o.Filename = "vault.env" },
+		},
+		{
+			name:   "filename with a slash",
+			labels: map[string]string{filenameLabel: "../vault.env"},
+			err:    true,
+		},
+		{
+			name:   "dot dot filename",
+			labels: map[string]string{filenameLabel: ".."},
+			err:    true,
+		},
+		{
+			name:   "empty filename",
+			labels: map[string]string{filenameLabel: ""},
+			err:    true,
+		},
+		{
+			name:   "format",
+			labels: map[string]string{formatLabel: "json"},
+			change: func(o *deliveryOptions) { o.Format = "json" },
+		},
+		{
+			name:   "unknown format",
+			labels: map[string]string{formatLabel: "toml"},
+			err:    true,
+		},
+		{
+			name:   "owner",
+			labels: map[string]string{uidLabel: "1000", gidLabel: "0"},
+			change: func(o *deliveryOptions) { o.Uid, o.Gid = 1000, 0 },
+		},
+		{
+			name:   "negative uid",
+			labels: map[string]string{uidLabel: "-1"},
+			err:    true,
+		},
+		{
+			name:   "named gid",
+			labels: map[string]string{gidLabel: "staff"},
+			err:    true,
+		},
+		{
+			name:   "mode",
+			labels: map[string]string{modeLabel: "0440"},
+			change: func(o *deliveryOptions) { o.Mode = 0440 },
+		},
+		{
+			name:   "decimal mode",
+			labels: map[string]string{modeLabel: "999"},
+			err:    true,
+		},
+		{
+			name:   "mode out of range",
+			labels: map[string]string{modeLabel: "1777"},
+			err:    true,
+		},
+		{
+			name:   "volume writer",
+			labels: map[string]string{writerLabel: writer.VolumeWriterType},
+			change: func(o *deliveryOptions) { o.Writer = writer.VolumeWriterType },
+		},
+		{
+			name:   "unknown writer",
+			labels: map[string]string{writerLabel: writer.ExecWriterType},
+			err:    true,
+		},
+		{
+			name:   "exec",
+			labels: map[string]string{execLabel: "/bin/load-secrets  --quiet"},
+			change: func(o *deliveryOptions) {
+				o.Writer = writer.ExecWriterType
+				o.Command = []string{"/bin/load-secrets", "--quiet"}
+			},
+		},
+		{
+			name:   "empty exec",
+			labels: map[string]string{execLabel: "  "},
+			err:    true,
+		},
+		{
+			name:   "exec with a writer",
+			labels: map[string]string{execLabel: "/bin/load-secrets", writerLabel: writer.VolumeWriterType},
+			err:    true,
+		},
+		{
+			name:   "signal name",
+			labels: map[string]string{signalLabel: "hup"},
+			change: func(o *deliveryOptions) { o.Signal = "SIGHUP" },
+		},
+		{
+			name:   "signal with prefix",
+			labels: map[string]string{signalLabel: "SIGUSR1"},
+			change: func(o *deliveryOptions) { o.Signal = "SIGUSR1" },
+		},
+		{
+			name:   "signal number",
+			labels: map[string]string{signalLabel: "1"},
+			change: func(o *deliveryOptions) { o.Signal = "1" },
+		},
+		{
+			name:   "malformed signal",
+			labels: map[string]string{signalLabel: "HUP; rm -rf /"},
+			err:    true,
+		},
+		{
+			name:   "empty signal",
+			labels: map[string]string{signalLabel: "SIG"},
+			err:    true,
+		},
+		{
+			name:   "reload",
+			labels: map[string]string{reloadLabel: "nginx -s reload"},
+			change: func(o *deliveryOptions) { o.Reload = []string{"nginx", "-s", "reload"} },
+		},
+		{
+			name:   "empty reload",
+			labels: map[string]string{reloadLabel: ""},
+			err:    true,
+		},
+		{
+			name:   "signal with reload",
+			labels: map[string]string{signalLabel: "HUP", reloadLabel: "nginx -s reload"},
+			err:    true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := parseDeliveryOptions(test.labels)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %#v", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		want := defaults
+		if test.change != nil {
+			test.change(&want)
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, *got, want)
+		}
+	}
+}
+
+func TestDeliveryOptionsFilePath(t *testing.T) {
+	opts, err := parseDeliveryOptions(map[string]string{pathLabel: "/run/secrets", filenameLabel: "vault.env"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.FilePath() != "/run/secrets/vault.env" {
+		t.Errorf("file path is %s", opts.FilePath())
+	}
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+)
+
+// peerPidPrefix marks a RemoteAddr that carries the caller's pid instead
+// of a network address.
+const peerPidPrefix = "pid:"
+
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+type peerAddr struct {
+	pid int32
+}
+
+func (p *peerAddr) Network() string {
+	return "unix"
+}
+
+func (p *peerAddr) String() string {
+	return fmt.Sprintf("%s%d", peerPidPrefix, p.pid)
+}
+
+// peerConn reports the peer's pid as its remote address so the HTTP
+// handler can see who called.
+type peerConn struct {
+	net.Conn
+	addr *peerAddr
+}
+
+func (p *peerConn) RemoteAddr() net.Addr {
+	return p.addr
+}
+
+// containerIDFromPid finds the Docker container a process runs in from its
+// cgroups. The agent has to share the host's pid namespace for this.
+func containerIDFromPid(pid int) (string, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if id := containerIDPattern.FindString(scanner.Text()); id != "" {
+			return id, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", errors.New("Process is not running in a container")
+}
@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+)
+
+type peerCredListener struct {
+	*net.UnixListener
+}
+
+func listenUnixWithPeerCred(path string) (net.Listener, error) {
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	return &peerCredListener{listener}, nil
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+
+		ucred, err := peerCred(conn)
+		if err != nil {
+			logrus.Warnf("Local API: dropping connection without peer credentials: %s", err)
+			conn.Close()
+			continue
+		}
+
+		return &peerConn{Conn: conn, addr: &peerAddr{pid: ucred.Pid}}, nil
+	}
+}
+
+func peerCred(conn *net.UnixConn) (*syscall.Ucred, error) {
+	file, err := conn.File()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return syscall.GetsockoptUcred(int(file.Fd()), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+}
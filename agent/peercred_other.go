@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"errors"
+	"net"
+)
+
+func listenUnixWithPeerCred(path string) (net.Listener, error) {
+	return nil, errors.New("Identifying callers on a unix socket is only supported on Linux")
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types/events"
+)
+
+// workerPool handles events on a fixed number of goroutines, one at a time per container.
+type workerPool struct {
+	handler    func(*events.Message) error
+	superseded func(*events.Message)
+	queue      chan *events.Message
+	slots      chan struct{}
+	done       chan struct{}
+	wg         sync.WaitGroup
+
+	mu      sync.Mutex
+	backlog map[string]*events.Message
+}
+
+// newWorkerPool calls superseded, if set, for waiting events replaced by newer ones.
+func newWorkerPool(handler func(*events.Message) error, superseded func(*events.Message), workers, queueSize int) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	p := &workerPool{
+		handler:    handler,
+		superseded: superseded,
+		queue:      make(chan *events.Message, workers+queueSize),
+		slots:      make(chan struct{}, workers+queueSize),
+		done:       make(chan struct{}),
+		backlog:    map[string]*events.Message{},
+	}
+
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+
+	logrus.Debugf("Started %d workers with a queue of %d", workers, queueSize)
+
+	return p
+}
+
+// Submit blocks while the queue is full, and returns false once the pool is stopped.
+func (p *workerPool) Submit(msg *events.Message) bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.done:
+		return false
+	}
+
+	p.mu.Lock()
+	waiting, busy := p.backlog[msg.ID]
+	if !busy {
+		p.backlog[msg.ID] = nil
+		p.mu.Unlock()
+		p.queue <- msg
+		return true
+	}
+	p.backlog[msg.ID] = msg
+	p.mu.Unlock()
+
+	logrus.Debugf("Container %s is being handled, queued %s event", msg.ID, msg.Action)
+	if waiting != nil {
+		<-p.slots
+		logrus.Debugf("Container %s had a %s event queued, dropped it for the %s event", msg.ID, waiting.Action, msg.Action)
+		if p.superseded != nil {
+			p.superseded(waiting)
+		}
+	}
+
+	return true
+}
+
+// Stop refuses new events and waits for queued and in-flight events to finish.
+func (p *workerPool) Stop() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case msg := <-p.queue:
+			p.run(msg)
+		case <-p.done:
+			// drain what was queued before the stop
+			for {
+				select {
+				case msg := <-p.queue:
+					p.run(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// run handles msg and then the event that waited for it, if any.
+func (p *workerPool) run(msg *events.Message) {
+	id := msg.ID
+
+	for {
+		wrapHandler(p.handler, msg)
+		<-p.slots
+
+		p.mu.Lock()
+		msg = p.backlog[id]
+		if msg == nil {
+			delete(p.backlog, id)
+			p.mu.Unlock()
+			return
+		}
+		p.backlog[id] = nil
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types/events"
+)
+
+func TestWorkerPoolOrdersEventsPerContainer(t *testing.T) {
+	tests := []struct {
+		workers    int
+		queueSize  int
+		containers int
+		events     int
+	}{
+		{workers: 1, queueSize: 0, containers: 3, events: 5},
+		{workers: 4, queueSize: 0, containers: 1, events: 20},
+		{workers: 4, queueSize: 10, containers: 8, events: 10},
+		{workers: 10, queueSize: 100, containers: 3, events: 30},
+		{workers: 0, queueSize: -1, containers: 2, events: 5},
+	}
+
+	for _, test := range tests {
+		name := fmt.Sprintf("%d workers, queue %d", test.workers, test.queueSize)
+
+		var mu sync.Mutex
+		active := map[string]bool{}
+		handled := map[string][]int{}
+		dropped := map[string]int{}
+		overlaps := 0
+
+		handler := func(msg *events.Message) error {
+			mu.Lock()
+			if active[msg.ID] {
+				overlaps++
+			}
+			active[msg.ID] = true
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			active[msg.ID] = false
+			handled[msg.ID] = append(handled[msg.ID], int(msg.TimeNano))
+			mu.Unlock()
+			return nil
+		}
+		superseded := func(msg *events.Message) {
+			mu.Lock()
+			dropped[msg.ID]++
+			mu.Unlock()
+		}
+
+		pool := newWorkerPool(handler, superseded, test.workers, test.queueSize)
+		for i := 0; i < test.events; i++ {
+			for c := 0; c < test.containers; c++ {
+				pool.Submit(&events.Message{ID: fmt.Sprintf("c%d", c), TimeNano: int64(i)})
+			}
+		}
+		pool.Stop()
+
+		if overlaps > 0 {
+			t.Errorf("%s: a container was handled by two workers at once %d times", name, overlaps)
+		}
+
+		for c := 0; c < test.containers; c++ {
+			id := fmt.Sprintf("c%d", c)
+			got := handled[id]
+			if len(got)+dropped[id] != test.events {
+				t.Errorf("%s: %s had %d events handled and %d dropped, want %d", name, id, len(got), dropped[id], test.events)
+				continue
+			}
+			if got[len(got)-1] != test.events-1 {
+				t.Errorf("%s: %s did not handle its latest event: %v", name, id, got)
+			}
+			for i := 1; i < len(got); i++ {
+				if got[i] <= got[i-1] {
+					t.Errorf("%s: %s handled %v out of order", name, id, got)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestWorkerPoolBoundsTheQueue(t *testing.T) {
+	release := make(chan struct{})
+	pool := newWorkerPool(func(*events.Message) error {
+		<-release
+		return nil
+	}, nil, 1, 2)
+	defer pool.Stop()
+	defer close(release)
+
+	accepted := make(chan string, 10)
+	go func() {
+		// c1 keeps the worker busy, the rest wait for it
+		for _, id := range []string{"c1", "c1", "c1", "c1", "c2", "c3"} {
+			pool.Submit(&events.Message{ID: id})
+			accepted <- id
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if len(accepted) != 5 {
+		t.Errorf("%d events accepted, want the handled c1, its latest event and c2", len(accepted))
+	}
+}
+
+func TestWorkerPoolRefusesAfterStop(t *testing.T) {
+	pool := newWorkerPool(func(*events.Message) error { return nil }, nil, 1, 1)
+	pool.Stop()
+
+	if pool.Submit(&events.Message{ID: "c"}) {
+		t.Error("expected Submit to fail on a stopped pool")
+	}
+}
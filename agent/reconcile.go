@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/events"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/rancher/secrets-bridge/writer"
+	"golang.org/x/net/context"
+)
+
+// reconciler finds running containers that should have credentials but
+// never got them, e.g. because they started before the agent did.
+type reconciler struct {
+	dockerClient *client.Client
+	handler      MessageHandler
+	deliveries   *deliveryLog
+	pool         *workerPool
+	rate         time.Duration
+}
+
+func newReconciler(dockerClient *client.Client, handler MessageHandler, deliveries *deliveryLog, pool *workerPool, rate time.Duration) *reconciler {
+	return &reconciler{
+		dockerClient: dockerClient,
+		handler:      handler,
+		deliveries:   deliveries,
+		pool:         pool,
+		rate:         rate,
+	}
+}
+
+// Run reconciles once, then every interval when it is set, until stop is closed.
+func (r *reconciler) Run(interval time.Duration, stop <-chan struct{}) {
+	r.reconcile(stop)
+
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.reconcile(stop)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (r *reconciler) reconcile(stop <-chan struct{}) {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("status", "running")
+
+	containers, err := r.dockerClient.ContainerList(context.Background(), types.ContainerListOptions{
+		Filter: filterArgs,
+	})
+	if err != nil {
+		logrus.Errorf("Reconcile: could not list containers: %s", err)
+		return
+	}
+
+	running := map[string]bool{}
+	pending := []*events.Message{}
+
+	for _, container := range containers {
+		running[container.ID] = true
+
+		if !r.handler.WantsSecrets(container.Labels) {
+			continue
+		}
+
+		deliveryOpts, err := parseDeliveryOptions(container.Labels)
+		if err != nil {
+			logrus.Warnf("Reconcile: skipping container %s: %s", container.ID, err)
+			continue
+		}
+
+		// exec deliveries leave no file behind to look for
+		if r.deliveries.Has(container.ID) ||
+			deliveryOpts.Writer != writer.ExecWriterType && r.hasSecretsFile(container.ID, deliveryOpts.FilePath()) {
+			continue
+		}
+
+		pending = append(pending, startMessage(container))
+	}
+
+	r.deliveries.Prune(running)
+
+	logrus.Infof("Reconcile: %d of %d running containers need credentials", len(pending), len(containers))
+
+	for _, msg := range pending {
+		select {
+		case <-stop:
+			return
+		case <-time.After(r.rate):
+		}
+
+		logrus.Debugf("Reconcile: handling container %s", msg.ID)
+		if !r.pool.Submit(msg) {
+			return
+		}
+	}
+}
+
+func (r *reconciler) hasSecretsFile(containerID, filePath string) bool {
+	_, err := r.dockerClient.ContainerStatPath(context.Background(), containerID, filePath)
+	return err == nil
+}
+
+// wantsSecrets is a cheap pre-filter on a container's own labels, the
+// handler still makes the final call.
+func wantsSecrets(labels map[string]string) bool {
+	if labels["secrets.bridge.enabled"] == "true" {
+		return true
+	}
+
+	// K8s labels live on the pod in metadata, not on the Docker container
+	if _, ok := labels["io.kubernetes.pod.namespace"]; ok {
+		return labels["io.kubernetes.container.name"] != "POD"
+	}
+
+	return false
+}
+
+// startMessage dresses a running container up as the start event the
+// handler would have received.
+func startMessage(container types.Container) *events.Message {
+	attributes := map[string]string{}
+	for key, value := range container.Labels {
+		attributes[key] = value
+	}
+
+	if len(container.Names) > 0 {
+		attributes["name"] = strings.TrimPrefix(container.Names[0], "/")
+	}
+	attributes["image"] = container.Image
+
+	return &events.Message{
+		Status: "start",
+		ID:     container.ID,
+		From:   container.Image,
+		Type:   "container",
+		Action: "start",
+		Actor: events.Actor{
+			ID:         container.ID,
+			Attributes: attributes,
+		},
+	}
+}
@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestWantsSecrets(t *testing.T) {
+	handler := &JsonHandler{watcher: &metadataWatcher{
+		changed: make(chan struct{}),
+		byPod: map[string]metadata.Container{
+			"default/web": {Labels: map[string]string{"secrets.bridge.enabled": "true", "secrets.bridge.containers": "app"}},
+			"default/db":  {Labels: map[string]string{"secrets.bridge.enabled": "false"}},
+		},
+	}}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		wants  bool
+	}{
+		{"enabled", map[string]string{"secrets.bridge.enabled": "true"}, true},
+		{"not labelled", map[string]string{}, false},
+		{"pod container", map[string]string{"io.kubernetes.pod.namespace": "default", "io.kubernetes.pod.name": "web", "io.kubernetes.container.name": "app"}, true},
+		{"container not selected", map[string]string{"io.kubernetes.pod.namespace": "default", "io.kubernetes.pod.name": "web", "io.kubernetes.container.name": "sidecar"}, false},
+		{"POD container", map[string]string{"io.kubernetes.pod.namespace": "default", "io.kubernetes.pod.name": "web", "io.kubernetes.container.name": "POD"}, false},
+		{"pod not enabled", map[string]string{"io.kubernetes.pod.namespace": "default", "io.kubernetes.pod.name": "db", "io.kubernetes.container.name": "db"}, false},
+		{"pod not in metadata", map[string]string{"io.kubernetes.pod.namespace": "default", "io.kubernetes.pod.name": "gone", "io.kubernetes.container.name": "app"}, false},
+	}
+
+	for _, test := range tests {
+		if wants := handler.WantsSecrets(test.labels); wants != test.wants {
+			t.Errorf("%s: wants secrets is %t, want %t", test.name, wants, test.wants)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"fmt"
+
+	"github.com/docker/engine-api/types/events"
+	"github.com/rancher/secrets-bridge/writer"
+	"github.com/urfave/cli"
+)
+
+// Runtime is the container runtime the agent watches, its events look like Docker's.
+type Runtime interface {
+	// Events follows container events with the given actions, replaying
+	// from since when the runtime can.
+	Events(since string, actions []string) (EventReader, error)
+	Inspect(containerID string) (*ContainerInfo, error)
+	// Running lists the IDs of the running containers.
+	Running() ([]string, error)
+	ReadFile(containerID, path string) ([]byte, error)
+	NewWriter(containerID string, opts map[string]interface{}) (writer.SecretWriter, error)
+	Signal(containerID, signal string) error
+	Exec(containerID, user string, command []string, stdin string) error
+}
+
+type EventReader interface {
+	Next() (*events.Message, error)
+	Close() error
+}
+
+type ContainerInfo struct {
+	ID      string
+	Name    string
+	Image   string
+	Labels  map[string]string
+	User    string
+	Running bool
+	Pid     int
+}
+
+func newRuntime(c *cli.Context) (Runtime, error) {
+	switch c.String("runtime") {
+	case "docker":
+		dockerClient, err := getDockerClient(c)
+		if err != nil {
+			return nil, err
+		}
+		return newDockerRuntime(dockerClient), nil
+	case "containerd":
+		return newContainerdRuntime(c.String("containerd-ctr"), c.String("containerd-address"), c.String("containerd-namespace")), nil
+	default:
+		return nil, fmt.Errorf("Unknown runtime: %s", c.String("runtime"))
+	}
+}
+
+// runtimeExecWriter hands the secret to a command through the runtime, for
+// runtimes the writer package knows nothing about.
+type runtimeExecWriter struct {
+	runtime     Runtime
+	containerID string
+	user        string
+	command     []string
+	message     string
+}
+
+func (r *runtimeExecWriter) Write() error {
+	return r.runtime.Exec(r.containerID, r.user, r.command, r.message)
+}
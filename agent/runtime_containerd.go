@@ -0,0 +1,371 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types/events"
+	"github.com/rancher/secrets-bridge/writer"
+)
+
+const ctrTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// containerdTopics maps the containerd events the agent cares about to
+// the Docker actions the rest of the agent knows.
+var containerdTopics = map[string]string{
+	"/tasks/start":       "start",
+	"/containers/delete": "destroy",
+}
+
+// containerdRuntime drives containerd through ctr and writes through /proc/<pid>/root.
+type containerdRuntime struct {
+	ctr       string
+	address   string
+	namespace string
+}
+
+func newContainerdRuntime(ctr, address, namespace string) *containerdRuntime {
+	return &containerdRuntime{
+		ctr:       ctr,
+		address:   address,
+		namespace: namespace,
+	}
+}
+
+func (c *containerdRuntime) command(args ...string) *exec.Cmd {
+	return exec.Command(c.ctr, append([]string{"--address", c.address, "--namespace", c.namespace}, args...)...)
+}
+
+func (c *containerdRuntime) output(args ...string) ([]byte, error) {
+	cmd := c.command(args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ctr %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// Events can't replay, containerd keeps no event history.
+func (c *containerdRuntime) Events(since string, actions []string) (EventReader, error) {
+	if since != "" {
+		logrus.Debugf("containerd can't replay events since %s", since)
+	}
+
+	wanted := map[string]bool{}
+	for _, action := range actions {
+		wanted[action] = true
+	}
+
+	cmd := c.command("events")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &containerdEventReader{
+		runtime: c,
+		cmd:     cmd,
+		stdout:  stdout,
+		scanner: bufio.NewScanner(stdout),
+		wanted:  wanted,
+	}, nil
+}
+
+type ctrContainer struct {
+	ID     string            `json:"ID"`
+	Image  string            `json:"Image"`
+	Labels map[string]string `json:"Labels"`
+	Spec   json.RawMessage   `json:"Spec"`
+}
+
+type ctrSpec struct {
+	Process *struct {
+		User struct {
+			UID uint32 `json:"uid"`
+			GID uint32 `json:"gid"`
+		} `json:"user"`
+	} `json:"process"`
+}
+
+func (c *containerdRuntime) Inspect(containerID string) (*ContainerInfo, error) {
+	out, err := c.output("containers", "info", containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	container := &ctrContainer{}
+	if err := json.Unmarshal(out, container); err != nil {
+		return nil, err
+	}
+
+	info := &ContainerInfo{
+		ID:     container.ID,
+		Name:   container.ID,
+		Image:  container.Image,
+		Labels: container.Labels,
+	}
+
+	if spec := decodeSpec(container.Spec); spec != nil && spec.Process != nil {
+		info.User = fmt.Sprintf("%d:%d", spec.Process.User.UID, spec.Process.User.GID)
+	}
+
+	info.Pid, info.Running, err = c.task(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// decodeSpec reads the OCI spec, which older ctr releases print as an
+// encoded protobuf Any.
+func decodeSpec(raw json.RawMessage) *ctrSpec {
+	spec := &ctrSpec{}
+	if err := json.Unmarshal(raw, spec); err == nil && spec.Process != nil {
+		return spec
+	}
+
+	any := struct {
+		Value string `json:"value"`
+	}{}
+	if err := json.Unmarshal(raw, &any); err != nil || any.Value == "" {
+		return nil
+	}
+
+	content, err := base64.StdEncoding.DecodeString(any.Value)
+	if err != nil {
+		return nil
+	}
+
+	spec = &ctrSpec{}
+	if err := json.Unmarshal(content, spec); err != nil {
+		return nil
+	}
+	return spec
+}
+
+// task finds the container's task in the output of ctr tasks ls, a
+// container without one has not started yet.
+func (c *containerdRuntime) task(containerID string) (int, bool, error) {
+	out, err := c.output("tasks", "ls")
+	if err != nil {
+		return 0, false, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != containerID {
+			continue
+		}
+
+		pid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, false, err
+		}
+		return pid, fields[2] == "RUNNING", nil
+	}
+
+	return 0, false, scanner.Err()
+}
+
+func (c *containerdRuntime) Running() ([]string, error) {
+	out, err := c.output("tasks", "ls")
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[2] == "RUNNING" {
+			ids = append(ids, fields[0])
+		}
+	}
+
+	return ids, scanner.Err()
+}
+
+func (c *containerdRuntime) rootfs(containerID string) (string, error) {
+	pid, running, err := c.task(containerID)
+	if err != nil {
+		return "", err
+	}
+	if !running || pid == 0 {
+		return "", fmt.Errorf("Container %s has no running task", containerID)
+	}
+	return fmt.Sprintf("/proc/%d/root", pid), nil
+}
+
+func (c *containerdRuntime) ReadFile(containerID, path string) ([]byte, error) {
+	rootfs, err := c.rootfs(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return writer.ReadInRoot(rootfs, path)
+}
+
+// NewWriter writes into the container through its root, which also reaches
+// any volume mounted at the delivery path.
+func (c *containerdRuntime) NewWriter(containerID string, opts map[string]interface{}) (writer.SecretWriter, error) {
+	if opts["writer"] == writer.ExecWriterType {
+		return &runtimeExecWriter{
+			runtime:     c,
+			containerID: containerID,
+			user:        fmt.Sprintf("%d:%d", opts["uid"], opts["gid"]),
+			command:     opts["command"].([]string),
+			message:     opts["message"].(string),
+		}, nil
+	}
+
+	rootfs, err := c.rootfs(containerID)
+	if err != nil {
+		return nil, err
+	}
+	opts["rootfs"] = rootfs
+
+	return writer.NewRootfsWriter(opts)
+}
+
+func (c *containerdRuntime) Signal(containerID, signal string) error {
+	_, err := c.output("tasks", "kill", "--signal", signal, containerID)
+	return err
+}
+
+func (c *containerdRuntime) Exec(containerID, user string, command []string, stdin string) error {
+	args := []string{"tasks", "exec", "--exec-id", "secrets-bridge-" + strconv.FormatInt(time.Now().UnixNano(), 36)}
+	if user != "" {
+		args = append(args, "--user", user)
+	}
+	args = append(args, containerID)
+	args = append(args, command...)
+
+	cmd := c.command(args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(out) > 4096 {
+			out = out[:4096]
+		}
+		return fmt.Errorf("Command %s in container %s failed: %s: %s", strings.Join(command, " "), containerID, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// containerdEventReader turns the lines ctr events prints,
+// "<timestamp> <namespace> <topic> <event json>", into Docker events.
+type containerdEventReader struct {
+	runtime *containerdRuntime
+	cmd     *exec.Cmd
+	stdout  io.ReadCloser
+	scanner *bufio.Scanner
+	wanted  map[string]bool
+}
+
+func (r *containerdEventReader) Next() (*events.Message, error) {
+	for r.scanner.Scan() {
+		msg, err := r.parse(r.scanner.Text())
+		if err != nil {
+			logrus.Debugf("Skipping containerd event: %s", err)
+			continue
+		}
+		if msg != nil {
+			return msg, nil
+		}
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (r *containerdEventReader) parse(line string) (*events.Message, error) {
+	fields := strings.SplitN(line, " ", 7)
+	if len(fields) < 7 {
+		return nil, fmt.Errorf("unexpected line: %s", line)
+	}
+
+	if fields[4] != r.runtime.namespace {
+		return nil, nil
+	}
+
+	action, ok := containerdTopics[fields[5]]
+	if !ok || !r.wanted[action] {
+		return nil, nil
+	}
+
+	timestamp, err := time.Parse(ctrTimeLayout, strings.Join(fields[:4], " "))
+	if err != nil {
+		return nil, err
+	}
+
+	event := struct {
+		ContainerID string `json:"container_id"`
+		ID          string `json:"id"`
+	}{}
+	if err := json.Unmarshal([]byte(fields[6]), &event); err != nil {
+		return nil, err
+	}
+
+	containerID := event.ContainerID
+	if containerID == "" {
+		containerID = event.ID
+	}
+
+	attributes := map[string]string{}
+	if action != "destroy" {
+		info, err := r.runtime.Inspect(containerID)
+		if err != nil {
+			return nil, err
+		}
+
+		// the CRI sandbox is the pod's pause container
+		if info.Labels["io.cri-containerd.kind"] == "sandbox" {
+			return nil, nil
+		}
+
+		for key, value := range info.Labels {
+			attributes[key] = value
+		}
+	}
+
+	return &events.Message{
+		Status:   action,
+		ID:       containerID,
+		Type:     "container",
+		Action:   action,
+		Time:     timestamp.Unix(),
+		TimeNano: timestamp.UnixNano(),
+		Actor: events.Actor{
+			ID:         containerID,
+			Attributes: attributes,
+		},
+	}, nil
+}
+
+func (r *containerdEventReader) Close() error {
+	r.stdout.Close()
+	if r.cmd.Process != nil {
+		r.cmd.Process.Kill()
+	}
+	return r.cmd.Wait()
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/events"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/rancher/secrets-bridge/writer"
+	"golang.org/x/net/context"
+)
+
+type dockerRuntime struct {
+	client *client.Client
+}
+
+func newDockerRuntime(dockerClient *client.Client) *dockerRuntime {
+	return &dockerRuntime{client: dockerClient}
+}
+
+func (d *dockerRuntime) Events(since string, actions []string) (EventReader, error) {
+	filterArgs := filters.NewArgs()
+	for _, action := range actions {
+		filterArgs.Add("event", action)
+	}
+
+	body, err := d.client.Events(context.Background(), types.EventsOptions{
+		Since:   since,
+		Filters: filterArgs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dockerEventReader{body: body, decoder: json.NewDecoder(body)}, nil
+}
+
+func (d *dockerRuntime) Inspect(containerID string) (*ContainerInfo, error) {
+	info, err := d.client.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	container := &ContainerInfo{
+		ID:   info.ID,
+		Name: strings.TrimPrefix(info.Name, "/"),
+	}
+	if info.Config != nil {
+		container.Image = info.Config.Image
+		container.Labels = info.Config.Labels
+		container.User = info.Config.User
+	}
+	if info.State != nil {
+		container.Running = info.State.Running
+		container.Pid = info.State.Pid
+	}
+
+	return container, nil
+}
+
+func (d *dockerRuntime) Running() ([]string, error) {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("status", "running")
+
+	containers, err := d.client.ContainerList(context.Background(), types.ContainerListOptions{
+		Filter: filterArgs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, container := range containers {
+		ids = append(ids, container.ID)
+	}
+	return ids, nil
+}
+
+func (d *dockerRuntime) ReadFile(containerID, path string) ([]byte, error) {
+	content, _, err := d.client.CopyFromContainer(context.Background(), containerID, path)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	tr := tar.NewReader(content)
+	if _, err := tr.Next(); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(io.LimitReader(tr, 1<<20))
+}
+
+func (d *dockerRuntime) NewWriter(containerID string, opts map[string]interface{}) (writer.SecretWriter, error) {
+	opts["dockerClient"] = d.client
+	opts["containerId"] = containerID
+	return writer.NewSecretWriter(opts)
+}
+
+func (d *dockerRuntime) Signal(containerID, signal string) error {
+	return d.client.ContainerKill(context.Background(), containerID, signal)
+}
+
+func (d *dockerRuntime) Exec(containerID, user string, command []string, stdin string) error {
+	return writer.Exec(d.client, containerID, user, command, stdin)
+}
+
+type dockerEventReader struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+}
+
+func (r *dockerEventReader) Next() (*events.Message, error) {
+	msg := &events.Message{}
+	if err := r.decoder.Decode(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (r *dockerEventReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,295 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/types/events"
+)
+
+const (
+	spoolDir = "spool"
+
+	// notifyAction marks a spooled event that only needs its hook run
+	notifyAction = "notify"
+
+	spoolBaseBackoff = 2 * time.Second
+	spoolMaxBackoff  = 60 * time.Second
+)
+
+// SpoolEntry is a delivery that failed in a way worth retrying.
+type SpoolEntry struct {
+	Event        *events.Message `json:"event"`
+	Attempts     int             `json:"attempts"`
+	FirstFailure time.Time       `json:"firstFailure"`
+	NextAttempt  time.Time       `json:"nextAttempt"`
+	Deadline     time.Time       `json:"deadline"`
+	LastError    string          `json:"lastError"`
+}
+
+// spool keeps failed deliveries on disk, one file per container, and feeds
+// them back into the worker pool as they come due.
+type spool struct {
+	dir    string
+	window time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]*SpoolEntry
+	inflight map[string]bool
+}
+
+func newSpool(stateDir string, window time.Duration) *spool {
+	s := &spool{
+		window:   window,
+		entries:  map[string]*SpoolEntry{},
+		inflight: map[string]bool{},
+	}
+
+	if stateDir == "" {
+		return s
+	}
+
+	dir := filepath.Join(stateDir, spoolDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logrus.Warnf("Can not create spool dir, failed deliveries will not survive a restart: %s", err)
+		return s
+	}
+	s.dir = dir
+
+	entries, err := ReadSpool(stateDir)
+	if err != nil {
+		logrus.Warnf("Can not read spool: %s", err)
+		return s
+	}
+
+	for _, entry := range entries {
+		s.entries[entry.Event.ID] = entry
+	}
+
+	if len(s.entries) > 0 {
+		logrus.Infof("Loaded %d spooled deliveries", len(s.entries))
+	}
+
+	return s
+}
+
+// ReadSpool returns the spooled deliveries in a state dir, oldest first.
+func ReadSpool(stateDir string) ([]*SpoolEntry, error) {
+	dir := filepath.Join(stateDir, spoolDir)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*SpoolEntry{}, nil
+		}
+		return nil, err
+	}
+
+	entries := []*SpoolEntry{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &SpoolEntry{}
+		if err := json.Unmarshal(content, entry); err != nil || entry.Event == nil {
+			logrus.Warnf("Ignoring corrupt spool entry: %s", file.Name())
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Sort(byFirstFailure(entries))
+
+	return entries, nil
+}
+
+// Failed records a failed delivery. Retryable failures are scheduled with
+// backoff until the deadline passes, everything else is dropped.
+func (s *spool) Failed(msg *events.Message, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inflight, msg.ID)
+
+	dErr, ok := err.(*deliveryError)
+	if !ok || !dErr.retryable {
+		s.remove(msg.ID)
+		return
+	}
+
+	// the credentials were written, only the hook is retried
+	if dErr.hook && msg.Action != notifyAction {
+		hookMsg := *msg
+		hookMsg.Action = notifyAction
+		msg = &hookMsg
+	}
+
+	now := time.Now()
+	entry, ok := s.entries[msg.ID]
+	if !ok {
+		entry = &SpoolEntry{
+			Event:        msg,
+			FirstFailure: now,
+			Deadline:     started(msg, now).Add(s.window),
+		}
+		s.entries[msg.ID] = entry
+	}
+
+	// credentials retried past their TTL would be expired on arrival
+	if dErr.ttl > 0 {
+		if deadline := started(entry.Event, entry.FirstFailure).Add(dErr.ttl); deadline.Before(entry.Deadline) {
+			entry.Deadline = deadline
+		}
+	}
+
+	entry.Event = msg
+	entry.Attempts++
+	entry.LastError = err.Error()
+	entry.NextAttempt = now.Add(retryDelay(entry.Attempts, dErr.retryAfter))
+
+	if entry.NextAttempt.After(entry.Deadline) {
+		logrus.Errorf("Giving up on container %s after %d attempts: %s", msg.ID, entry.Attempts, err)
+		s.remove(msg.ID)
+		return
+	}
+
+	logrus.Warnf("Delivery to container %s failed, retrying at %s: %s", msg.ID, entry.NextAttempt.Format(time.RFC3339), err)
+	s.save(entry)
+}
+
+func (s *spool) Delivered(msg *events.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inflight, msg.ID)
+	s.remove(msg.ID)
+}
+
+// Run submits due entries to the pool until stop is closed.
+func (s *spool) Run(pool *workerPool, stop <-chan struct{}) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, msg := range s.due() {
+			logrus.Debugf("Retrying delivery to container %s", msg.ID)
+			if !pool.Submit(msg) {
+				return
+			}
+		}
+	}
+}
+
+func (s *spool) due() []*events.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	due := []*events.Message{}
+
+	for id, entry := range s.entries {
+		if s.inflight[id] || now.Before(entry.NextAttempt) {
+			continue
+		}
+
+		if now.After(entry.Deadline) {
+			logrus.Errorf("Giving up on container %s, its delivery window has passed", id)
+			s.remove(id)
+			continue
+		}
+
+		s.inflight[id] = true
+		due = append(due, entry.Event)
+	}
+
+	return due
+}
+
+func (s *spool) save(entry *SpoolEntry) {
+	if s.dir == "" {
+		return
+	}
+
+	content, err := json.Marshal(entry)
+	if err != nil {
+		logrus.Warnf("Can not encode spool entry: %s", err)
+		return
+	}
+
+	path := filepath.Join(s.dir, entry.Event.ID+".json")
+	if err := ioutil.WriteFile(path+".tmp", content, 0600); err != nil {
+		logrus.Warnf("Can not write spool entry: %s", err)
+		return
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		logrus.Warnf("Can not write spool entry: %s", err)
+	}
+}
+
+func (s *spool) remove(id string) {
+	if _, ok := s.entries[id]; !ok {
+		return
+	}
+	delete(s.entries, id)
+
+	if s.dir != "" {
+		os.Remove(filepath.Join(s.dir, id+".json"))
+	}
+}
+
+// started is when the container's event happened, or fallback for
+// reconciled containers.
+func started(msg *events.Message, fallback time.Time) time.Time {
+	if msg.TimeNano != 0 {
+		return time.Unix(0, msg.TimeNano)
+	}
+	return fallback
+}
+
+// retryDelay backs off exponentially with +/-20% jitter, but never retries
+// sooner than the server asked.
+func retryDelay(attempts int, retryAfter time.Duration) time.Duration {
+	delay := spoolBaseBackoff
+	for i := 1; i < attempts && delay < spoolMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > spoolMaxBackoff {
+		delay = spoolMaxBackoff
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(delay)*2/5)) - delay/5
+	delay += jitter
+
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+
+	return delay
+}
+
+type byFirstFailure []*SpoolEntry
+
+func (b byFirstFailure) Len() int           { return len(b) }
+func (b byFirstFailure) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byFirstFailure) Less(i, j int) bool { return b[i].FirstFailure.Before(b[j].FirstFailure) }
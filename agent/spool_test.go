@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types/events"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts   int
+		retryAfter time.Duration
+		min, max   time.Duration
+	}{
+		{1, 0, 1600 * time.Millisecond, 2400 * time.Millisecond},
+		{3, 0, 6400 * time.Millisecond, 9600 * time.Millisecond},
+		{50, 0, 48 * time.Second, 72 * time.Second},
+		{1, 30 * time.Second, 30 * time.Second, 30 * time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if delay := retryDelay(test.attempts, test.retryAfter); delay < test.min || delay > test.max {
+				t.Errorf("attempt %d: delay %s is outside %s to %s", test.attempts, delay, test.min, test.max)
+				break
+			}
+		}
+	}
+}
+
+func TestSpoolFailed(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		started  time.Time
+		err      error
+		spooled  bool
+		deadline time.Time
+	}{
+		{"not retryable", now, errors.New("bad label"), false, time.Time{}},
+		{"retryable", now, &deliveryError{err: errors.New("503"), retryable: true}, true, now.Add(270 * time.Second)},
+		{"capped by ttl", now, &deliveryError{err: errors.New("write"), retryable: true, ttl: time.Minute}, true, now.Add(time.Minute)},
+		{"past the window", now.Add(-5 * time.Minute), &deliveryError{err: errors.New("503"), retryable: true}, false, time.Time{}},
+		{"past the ttl", now.Add(-2 * time.Minute), &deliveryError{err: errors.New("write"), retryable: true, ttl: time.Minute}, false, time.Time{}},
+	}
+
+	for _, test := range tests {
+		s := newSpool("", 270*time.Second)
+		s.Failed(&events.Message{ID: "c1", Action: "start", TimeNano: test.started.UnixNano()}, test.err)
+
+		entry, ok := s.entries["c1"]
+		if ok != test.spooled {
+			t.Errorf("%s: spooled is %t, want %t", test.name, ok, test.spooled)
+			continue
+		}
+		if ok && !entry.Deadline.Equal(test.deadline) {
+			t.Errorf("%s: deadline is %s, want %s", test.name, entry.Deadline, test.deadline)
+		}
+	}
+}
+
+func TestSpoolSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets-bridge-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	msg := &events.Message{ID: "c1", Action: "start", TimeNano: time.Now().UnixNano()}
+	newSpool(dir, time.Minute).Failed(msg, &deliveryError{err: errors.New("503"), retryable: true})
+
+	s := newSpool(dir, time.Minute)
+	if _, ok := s.entries["c1"]; !ok {
+		t.Fatal("spooled delivery was not reloaded")
+	}
+
+	s.Delivered(msg)
+	if entries, _ := ReadSpool(dir); len(entries) != 0 {
+		t.Errorf("%d entries left on disk after delivery", len(entries))
+	}
+}
+
+type fakeHandler struct {
+	MessageHandler
+	handled  int
+	notified int
+}
+
+func (f *fakeHandler) Handle(*events.Message) error {
+	f.handled++
+	return nil
+}
+
+func (f *fakeHandler) Notify(*events.Message) error {
+	f.notified++
+	return nil
+}
+
+func TestEventHandlerSettlesSpooledDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets-bridge-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a reconciled container failed, then got its credentials from the
+	// stream while the retry waited
+	msg := &events.Message{ID: "c1", Action: "start"}
+	retries := newSpool("", time.Minute)
+	retries.Failed(msg, &deliveryError{err: errors.New("503"), retryable: true})
+	retries.entries["c1"].NextAttempt = time.Now()
+	if due := retries.due(); len(due) != 1 {
+		t.Fatalf("%d deliveries due, want 1", len(due))
+	}
+
+	deliveries := newDeliveryLog(dir)
+	deliveries.Record("c1")
+
+	handler := &fakeHandler{}
+	if err := eventHandler(handler, deliveries, newEventCheckpoint(""), retries, "", "")(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if handler.handled != 0 {
+		t.Error("the delivered container was handled again")
+	}
+	if len(retries.entries) != 0 || len(retries.inflight) != 0 {
+		t.Errorf("spool kept %d entries, %d in flight", len(retries.entries), len(retries.inflight))
+	}
+}
+
+func TestEventHandlerRetriesOnlyTheHook(t *testing.T) {
+	msg := &events.Message{ID: "c1", Action: "start", TimeNano: time.Now().UnixNano()}
+	retries := newSpool("", time.Minute)
+	retries.Failed(msg, &deliveryError{err: errors.New("Hook signal failed"), retryable: true, hook: true})
+	retries.entries["c1"].NextAttempt = time.Now()
+
+	due := retries.due()
+	if len(due) != 1 || due[0].Action != notifyAction {
+		t.Fatalf("due %#v, want the hook of c1", due)
+	}
+
+	handler := &fakeHandler{}
+	if err := eventHandler(handler, newDeliveryLog(""), newEventCheckpoint(""), retries, "", "")(due[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if handler.handled != 0 || handler.notified != 1 {
+		t.Errorf("handled %d times and notified %d, want only notified once", handler.handled, handler.notified)
+	}
+	if len(retries.entries) != 0 {
+		t.Errorf("spool kept %d entries", len(retries.entries))
+	}
+}
@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// ShowSpool prints the deliveries an agent is waiting to retry.
+func ShowSpool(c *cli.Context) {
+	entries, err := ReadSpool(c.String("state-dir"))
+	if err != nil {
+		logrus.Fatalf("Could not read spool: %s", err)
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No deliveries waiting to be retried")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tATTEMPTS\tNEXT ATTEMPT\tDEADLINE\tLAST ERROR")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n",
+			shortID(entry.Event.ID),
+			entry.Attempts,
+			entry.NextAttempt.Format(time.RFC3339),
+			entry.Deadline.Format(time.RFC3339),
+			entry.LastError)
+	}
+	w.Flush()
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	// metadataWait is how long a lookup waits for a container to show up
+	// in rancher-metadata.
+	metadataWait = 2 * time.Minute
+
+	// metadataPollWait is how long rancher-metadata holds a version
+	// request open before answering that nothing changed.
+	metadataPollWait = 60
+)
+
+var errNotInMetadata = errors.New("Container not found in metadata")
+
+// metadataWatcher keeps an indexed copy of rancher-metadata's containers.
+type metadataWatcher struct {
+	client *metadata.Client
+
+	mu      sync.Mutex
+	version string
+	byName  map[string][]metadata.Container
+	byPod   map[string]metadata.Container
+	byID    map[string]metadata.Container
+	changed chan struct{}
+}
+
+func newMetadataWatcher(client *metadata.Client) *metadataWatcher {
+	w := &metadataWatcher{
+		client:  client,
+		byName:  map[string][]metadata.Container{},
+		byPod:   map[string]metadata.Container{},
+		byID:    map[string]metadata.Container{},
+		changed: make(chan struct{}),
+	}
+
+	version, err := w.getVersion("/version")
+	if err != nil {
+		logrus.Warnf("Could not read metadata version: %s", err)
+	} else if err := w.refresh(version); err != nil {
+		logrus.Warnf("Could not read containers from metadata: %s", err)
+	}
+
+	go w.run()
+
+	return w
+}
+
+// run long polls rancher-metadata for a new version and refreshes the
+// index when there is one.
+func (w *metadataWatcher) run() {
+	backoff := 1 * time.Second
+	maxBackoff := 30 * time.Second
+
+	for {
+		version, err := w.waitForChange()
+		if err == nil && version != w.currentVersion() {
+			err = w.refresh(version)
+		}
+
+		if err != nil {
+			logrus.Warnf("Metadata watch failed, retrying in %s: %s", backoff, err)
+			time.Sleep(backoff)
+			if backoff < maxBackoff {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = 1 * time.Second
+	}
+}
+
+func (w *metadataWatcher) waitForChange() (string, error) {
+	return w.getVersion("/version?wait=true&maxWait=" + strconv.Itoa(metadataPollWait) + "&value=" + url.QueryEscape(w.currentVersion()))
+}
+
+// getVersion unquotes the version, the client asks for JSON.
+func (w *metadataWatcher) getVersion(path string) (string, error) {
+	resp, err := w.client.SendRequest(path)
+	if err != nil {
+		return "", err
+	}
+
+	var version string
+	if err := json.Unmarshal(resp, &version); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+func (w *metadataWatcher) currentVersion() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.version
+}
+
+func (w *metadataWatcher) refresh(version string) error {
+	containers, err := w.client.GetContainers()
+	if err != nil {
+		return err
+	}
+
+	byName := map[string][]metadata.Container{}
+	byPod := map[string]metadata.Container{}
+	byID := map[string]metadata.Container{}
+	for _, container := range containers {
+		byName[container.Name] = append(byName[container.Name], container)
+		if container.ExternalId != "" {
+			byID[container.ExternalId] = container
+		}
+		if namespace, ok := container.Labels["io.kubernetes.pod.namespace"]; ok {
+			byPod[namespace+"/"+container.Name] = container
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	logrus.Debugf("Metadata version %s has %d containers", version, len(containers))
+	w.version = version
+	w.byName = byName
+	w.byPod = byPod
+	w.byID = byID
+	close(w.changed)
+	w.changed = make(chan struct{})
+
+	return nil
+}
+
+// FindContainer returns the container with name whose label key is value.
+func (w *metadataWatcher) FindContainer(name, key, value string, wait time.Duration) (metadata.Container, error) {
+	return w.find(wait, func() (metadata.Container, bool) {
+		for _, container := range w.byName[name] {
+			if labelValue, ok := container.Labels[key]; ok && labelValue == value {
+				return container, true
+			}
+		}
+		return metadata.Container{}, false
+	})
+}
+
+// PrimaryIP is the IP Rancher assigned the container with the Docker ID
+// externalID, empty when metadata doesn't know it.
+func (w *metadataWatcher) PrimaryIP(externalID string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.byID[externalID].PrimaryIp
+}
+
+// FindPod returns the pod's container once match accepts it, pod labels
+// can show up in metadata after the pod itself does.
+func (w *metadataWatcher) FindPod(namespace, name string, match func(metadata.Container) bool, wait time.Duration) (metadata.Container, error) {
+	return w.find(wait, func() (metadata.Container, bool) {
+		container, ok := w.byPod[namespace+"/"+name]
+		return container, ok && match(container)
+	})
+}
+
+// find checks the index with lookup, then again on every change, until
+// wait has passed.
+func (w *metadataWatcher) find(wait time.Duration, lookup func() (metadata.Container, bool)) (metadata.Container, error) {
+	timeout := time.After(wait)
+
+	for {
+		w.mu.Lock()
+		container, ok := lookup()
+		changed := w.changed
+		w.mu.Unlock()
+
+		if ok {
+			return container, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return metadata.Container{}, errNotInMetadata
+		}
+	}
+}
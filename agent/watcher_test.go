@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// fakeMetadata answers like rancher-metadata does for Accept: application/json,
+// holding version requests open until the version changes.
+type fakeMetadata struct {
+	mu         sync.Mutex
+	version    string
+	containers []metadata.Container
+	changed    chan struct{}
+	waits      []string
+	done       chan struct{}
+}
+
+func (f *fakeMetadata) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	switch r.URL.Path {
+	case "/containers":
+		json.NewEncoder(w).Encode(f.containers)
+	case "/version":
+		if r.URL.Query().Get("wait") == "true" {
+			f.waits = append(f.waits, r.URL.Query().Get("value"))
+			if r.URL.Query().Get("value") == f.version {
+				changed := f.changed
+				f.mu.Unlock()
+				select {
+				case <-changed:
+				case <-f.done:
+				}
+				f.mu.Lock()
+			}
+		}
+		json.NewEncoder(w).Encode(f.version)
+	default:
+		http.NotFound(w, r)
+	}
+	f.mu.Unlock()
+}
+
+func (f *fakeMetadata) update(version string, containers ...metadata.Container) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.version = version
+	f.containers = containers
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func TestMetadataWatcherLongPolls(t *testing.T) {
+	fake := &fakeMetadata{version: "1", changed: make(chan struct{}), done: make(chan struct{})}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	defer close(fake.done)
+
+	w := newMetadataWatcher(metadata.NewClient(server.URL))
+	if w.currentVersion() != "1" {
+		t.Fatalf("version is %q, want 1", w.currentVersion())
+	}
+
+	found := make(chan error, 1)
+	go func() {
+		_, err := w.FindContainer("web", "io.rancher.container.uuid", "uuid-1", 5*time.Second)
+		found <- err
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	fake.mu.Lock()
+	waits := append([]string{}, fake.waits...)
+	fake.mu.Unlock()
+	if len(waits) != 1 || waits[0] != "1" {
+		t.Fatalf("watcher polled with %q, want one request held open for version 1", waits)
+	}
+
+	fake.update("2", metadata.Container{Name: "web", Labels: map[string]string{"io.rancher.container.uuid": "uuid-1"}})
+	if err := <-found; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if w.currentVersion() != "2" {
+		t.Errorf("version is %q, want 2", w.currentVersion())
+	}
+}
+
+func TestMetadataWatcherFindTimesOut(t *testing.T) {
+	w := &metadataWatcher{changed: make(chan struct{})}
+
+	start := time.Now()
+	if _, err := w.FindContainer("web", "io.rancher.container.uuid", "uuid-1", 50*time.Millisecond); err != errNotInMetadata {
+		t.Errorf("expected %q, got %v", errNotInMetadata, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("find gave up after %s, want 50ms", elapsed)
+	}
+}
@@ -0,0 +1,77 @@
+package bridge
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/secrets-bridge/vault"
+	"github.com/urfave/cli"
+)
+
+// Bootstrap provisions Vault for a bridge server with an admin token and
+// prints how to start the server.
+func Bootstrap(c *cli.Context) {
+	environment := c.String("environment")
+
+	config := &vault.BootstrapConfig{
+		Environment: environment,
+		ConfigPath:  strings.TrimSuffix(c.String("config-path"), "/"),
+		Policy:      c.String("policy"),
+		TokenRole:   c.String("token-role"),
+		TokenTTL:    c.String("token-ttl"),
+		CubbyPath:   c.String("cubbypath"),
+		ExamplePath: c.String("example-path"),
+		Rotate:      c.Bool("rotate"),
+	}
+
+	// defaults are scoped to the environment, like the setup guide
+	if config.ConfigPath == "" {
+		config.ConfigPath = "secret/secrets-bridge/" + environment
+	}
+	if config.Policy == "" {
+		config.Policy = "grantor-" + strings.ToLower(environment)
+	}
+	if config.TokenRole == "" {
+		config.TokenRole = config.Policy
+	}
+	if config.CubbyPath == "" {
+		config.CubbyPath = "cubbyhole/" + environment
+	}
+
+	for _, policy := range strings.Split(c.String("app-policies"), ",") {
+		if policy = strings.TrimSpace(policy); policy != "" {
+			config.AppPolicies = append(config.AppPolicies, policy)
+		}
+	}
+
+	client, err := vault.NewAdminClient(map[string]interface{}{
+		"vault-url":    c.String("vault-url"),
+		"vault-token":  c.String("vault-token"),
+		"vault-cacert": c.String("vault-cacert"),
+	})
+	if err != nil {
+		logrus.Fatalf("Can not connect to Vault: %s", err)
+	}
+
+	result, err := vault.Bootstrap(client, config)
+	if err != nil {
+		logrus.Fatalf("Bootstrap failed: %s", err)
+	}
+
+	if !result.CreatedToken {
+		fmt.Println("# Reused the issuing token from an earlier run, pass --rotate to replace it")
+	}
+	fmt.Println("# Start the server within 15 minutes, the temp token can be used once")
+
+	flags := []string{
+		"--vault-url " + c.String("vault-url"),
+		"--vault-cubbypath " + result.CubbyPath,
+		"--vault-token " + result.TempToken,
+	}
+	if cacert := c.String("vault-cacert"); cacert != "" {
+		flags = append(flags, "--vault-cacert "+cacert)
+	}
+
+	fmt.Printf("secrets-bridge server %s\n", strings.Join(flags, " "))
+}
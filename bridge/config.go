@@ -0,0 +1,81 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/urfave/cli"
+)
+
+// EnvironmentConfig describes one Rancher environment served by the bridge.
+// VaultConfigPath and TokenRole override what the issuing token carries.
+type EnvironmentConfig struct {
+	Name             string `json:"name"`
+	RancherURL       string `json:"rancherUrl"`
+	RancherAccessKey string `json:"rancherAccessKey"`
+	RancherSecretKey string `json:"rancherSecretKey"`
+	VaultConfigPath  string `json:"vaultConfigPath,omitempty"`
+	TokenRole        string `json:"tokenRole,omitempty"`
+}
+
+type ServerConfig struct {
+	Environments []EnvironmentConfig `json:"environments"`
+}
+
+// loadServerConfig reads the environments from --config when given, or
+// builds a single unnamed environment from the --rancher-* flags.
+func loadServerConfig(c *cli.Context) (*ServerConfig, error) {
+	configFile := c.String("config")
+	if configFile == "" {
+		return &ServerConfig{
+			Environments: []EnvironmentConfig{
+				{
+					RancherURL:       c.String("rancher-url"),
+					RancherAccessKey: c.String("rancher-access"),
+					RancherSecretKey: c.String("rancher-secret"),
+				},
+			},
+		}, nil
+	}
+
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ServerConfig{}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("Could not parse config file %s: %s", configFile, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (sc *ServerConfig) validate() error {
+	if len(sc.Environments) == 0 {
+		return errors.New("No environments defined in config")
+	}
+
+	seen := map[string]bool{}
+	for _, env := range sc.Environments {
+		if env.Name == "" {
+			return errors.New("Every environment in the config needs a name")
+		}
+		if seen[env.Name] {
+			return fmt.Errorf("Environment %s is defined more than once", env.Name)
+		}
+		seen[env.Name] = true
+
+		if env.RancherURL == "" || env.RancherAccessKey == "" || env.RancherSecretKey == "" {
+			return fmt.Errorf("Environment %s needs a rancherUrl, rancherAccessKey and rancherSecretKey", env.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package bridge
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/secrets-bridge/verifier"
+	"github.com/urfave/cli"
+)
+
+func TestLoadServerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets-bridge-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		config  string
+		flags   map[string]string
+		want    []EnvironmentConfig
+		wantErr bool
+	}{
+		{
+			name: "flags",
+			flags: map[string]string{
+				"rancher-url":    "http://rancher/v1/projects/1a5",
+				"rancher-access": "access",
+				"rancher-secret": "secret",
+			},
+			want: []EnvironmentConfig{
+				{RancherURL: "http://rancher/v1/projects/1a5", RancherAccessKey: "access", RancherSecretKey: "secret"},
+			},
+		},
+		{
+			name: "environments",
+			config: `{"environments": [
+				{"name": "dev", "rancherUrl": "http://rancher/v1/projects/1a5", "rancherAccessKey": "a", "rancherSecretKey": "s"},
+				{"name": "prod", "rancherUrl": "http://rancher/v1/projects/1a6", "rancherAccessKey": "a", "rancherSecretKey": "s", "vaultConfigPath": "secret/prod", "tokenRole": "prod"}
+			]}`,
+			want: []EnvironmentConfig{
+				{Name: "dev", RancherURL: "http://rancher/v1/projects/1a5", RancherAccessKey: "a", RancherSecretKey: "s"},
+				{Name: "prod", RancherURL: "http://rancher/v1/projects/1a6", RancherAccessKey: "a", RancherSecretKey: "s", VaultConfigPath: "secret/prod", TokenRole: "prod"},
+			},
+		},
+		{
+			name:    "no environments",
+			config:  `{"environments": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "unnamed environment",
+			config:  `{"environments": [{"rancherUrl": "http://rancher", "rancherAccessKey": "a", "rancherSecretKey": "s"}]}`,
+			wantErr: true,
+		},
+		{
+			name: "duplicate environment",
+			config: `{"environments": [
+				{"name": "dev", "rancherUrl": "http://rancher", "rancherAccessKey": "a", "rancherSecretKey": "s"},
+				{"name": "dev", "rancherUrl": "http://rancher", "rancherAccessKey": "a", "rancherSecretKey": "s"}
+			]}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing keys",
+			config:  `{"environments": [{"name": "dev", "rancherUrl": "http://rancher"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "malformed",
+			config:  `{"environments": [`,
+			wantErr: true,
+		},
+		{
+			name:    "missing file",
+			flags:   map[string]string{"config": filepath.Join(dir, "missing.json")},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		flags := test.flags
+		if test.config != "" {
+			file := filepath.Join(dir, test.name+".json")
+			if err := ioutil.WriteFile(file, []byte(test.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			flags = map[string]string{"config": file}
+		}
+
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		for _, name := range []string{"config", "rancher-url", "rancher-access", "rancher-secret"} {
+			set.String(name, flags[name], "")
+		}
+
+		config, err := loadServerConfig(cli.NewContext(nil, set, nil))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		if len(config.Environments) != len(test.want) {
+			t.Errorf("%s: got %d environments, want %d", test.name, len(config.Environments), len(test.want))
+			continue
+		}
+		for j, env := range config.Environments {
+			if env != test.want[j] {
+				t.Errorf("%s: environment %d is %#v, want %#v", test.name, j, env, test.want[j])
+			}
+		}
+	}
+}
+
+type agentVerifier struct {
+	verifier.Verifier
+	hosts map[string]string
+}
+
+func (v *agentVerifier) AgentHost(uuid string) (string, error) {
+	if hostID, ok := v.hosts[uuid]; ok {
+		return hostID, nil
+	}
+	return "", errors.New("Agent container not found")
+}
+
+func TestForAgent(t *testing.T) {
+	dev := &environmentActors{verifier: &agentVerifier{hosts: map[string]string{"agent-1": "1h1"}}}
+	prod := &environmentActors{verifier: &agentVerifier{hosts: map[string]string{"agent-2": "1h2"}}}
+	unnamed := map[string]*environmentActors{"": dev}
+	named := map[string]*environmentActors{"dev": dev, "prod": prod}
+
+	tests := []struct {
+		name         string
+		environments map[string]*environmentActors
+		uuid         string
+		reported     string
+		want         string
+		err          bool
+	}{
+		{"named", named, "agent-2", "prod", "prod", false},
+		{"reported another environment", named, "agent-2", "dev", "", true},
+		{"reported nothing", named, "agent-1", "", "", true},
+		{"unknown agent", named, "agent-3", "dev", "", true},
+		{"unnamed", unnamed, "agent-1", "anything", "", false},
+		{"unnamed unknown agent", unnamed, "agent-2", "anything", "", true},
+	}
+
+	for _, test := range tests {
+		sa := &serverActors{environments: test.environments}
+
+		environment, env, hostID, err := sa.forAgent(test.uuid, test.reported)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if environment != test.want || env != test.environments[test.want] || hostID == "" {
+			t.Errorf("%s: routed to %q on host %q", test.name, environment, hostID)
+		}
+	}
+}
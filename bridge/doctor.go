@@ -0,0 +1,205 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/rancher/secrets-bridge/doctor"
+	"github.com/rancher/secrets-bridge/vault"
+	"github.com/rancher/secrets-bridge/verifier"
+	"github.com/urfave/cli"
+)
+
+// DoctorServer checks what the server needs from Vault and Rancher, with
+// the same flags the server is started with.
+func DoctorServer(c *cli.Context) {
+	report := doctor.NewReport()
+
+	vaultURL := c.String("vault-url")
+	if caFile := c.String("vault-cacert"); caFile != "" {
+		if err := vault.CheckCACert(caFile); err != nil {
+			report.Fail("Vault CA", err, "--vault-cacert must be a PEM file holding the CA that signed Vault's certificate")
+		} else {
+			report.Pass("Vault CA", caFile)
+		}
+	} else if strings.HasPrefix(vaultURL, "https://") {
+		report.Pass("Vault CA", "using the system's CAs")
+	} else {
+		report.Skip("Vault CA", "Vault is not served over https")
+	}
+
+	client, err := vault.NewAdminClient(map[string]interface{}{
+		"vault-url":    vaultURL,
+		"vault-cacert": c.String("vault-cacert"),
+	})
+	if err != nil {
+		report.Fail("Vault address", err, "check --vault-url and --vault-cacert")
+		report.Exit()
+	}
+
+	status, err := client.Sys().SealStatus()
+	switch {
+	case err != nil:
+		report.Fail("Vault address", err, "check --vault-url, that Vault is reachable from here, and --vault-cacert for https")
+	case status.Sealed:
+		report.Fail("Vault address", errors.New(vaultURL+" is sealed"), "unseal Vault")
+	default:
+		report.Pass("Vault address", vaultURL+" is unsealed")
+	}
+
+	config, err := loadServerConfig(c)
+	if err != nil {
+		report.Fail("Server config", err, "fix the file passed with --config")
+		report.Exit()
+	}
+
+	token := c.String("issuing-token")
+	if token == "" {
+		report.Skip("Issuing token", "pass --issuing-token to check it, the temp token can't be used without spending it")
+	} else {
+		client.SetToken(token)
+		checkIssuingToken(report, client, config, c.Bool("require-token-role"))
+	}
+
+	for _, env := range config.Environments {
+		checkRancher(report, env)
+	}
+
+	report.Exit()
+}
+
+func checkIssuingToken(report *doctor.Report, client *api.Client, config *ServerConfig, requireRole bool) {
+	info, err := vault.InspectToken(client)
+	if err != nil {
+		report.Fail("Issuing token", err, "the token may have expired, run secrets-bridge bootstrap to create a new one")
+		return
+	}
+
+	switch {
+	case info.TTL == 0:
+		report.Pass("Issuing token TTL", "never expires")
+	case info.TTL <= 180:
+		report.Fail("Issuing token TTL", fmt.Errorf("only %s left", time.Duration(info.TTL)*time.Second),
+			"the server renews the token 3 minutes before it expires, create one with a longer TTL")
+	case !info.Renewable:
+		report.Fail("Issuing token TTL", fmt.Errorf("%s left and not renewable", time.Duration(info.TTL)*time.Second),
+			"the server can't keep a token that isn't renewable, create a renewable one")
+	default:
+		report.Pass("Issuing token TTL", fmt.Sprintf("%s left, renewable", time.Duration(info.TTL)*time.Second))
+	}
+
+	for _, env := range config.Environments {
+		name := environmentName(env)
+
+		role := info.Role
+		if env.TokenRole != "" {
+			role = env.TokenRole
+		}
+		checkTokenRole(report, client, name, role, requireRole)
+
+		configPath := info.ConfigPath
+		if env.VaultConfigPath != "" {
+			configPath = env.VaultConfigPath
+		}
+		checkConfigPath(report, client, name, configPath)
+	}
+}
+
+func checkTokenRole(report *doctor.Report, client *api.Client, name, role string, requireRole bool) {
+	check := "Token role (" + name + ")"
+
+	if role == "" {
+		if requireRole {
+			report.Fail(check, errors.New("the issuing token has no role"),
+				"create the issuing token through auth/token/create/<role>, or set tokenRole in --config")
+		} else {
+			report.Pass(check, "none, tokens are created as children of the issuing token")
+		}
+		return
+	}
+
+	capabilities, err := client.Sys().CapabilitiesSelf("auth/token/create/" + role)
+	if err != nil {
+		report.Fail(check, err, "the issuing token must be able to look up its own capabilities")
+		return
+	}
+
+	if !hasCapability(capabilities, "update", "create", "root") {
+		report.Fail(check, fmt.Errorf("can't create tokens on role %s", role),
+			fmt.Sprintf(`add path "auth/token/create/%s" { capabilities = ["update"] } to the bridge's policy`, role))
+		return
+	}
+
+	report.Pass(check, role)
+}
+
+func checkConfigPath(report *doctor.Report, client *api.Client, name, configPath string) {
+	check := "Config path (" + name + ")"
+
+	if configPath == "" {
+		report.Fail(check, errors.New("the issuing token has no configPath metadata"),
+			"create the issuing token with meta configPath, or set vaultConfigPath in --config")
+		return
+	}
+
+	secret, err := client.Logical().List(configPath)
+	if err != nil {
+		report.Fail(check, err, fmt.Sprintf(`add path "%s/*" { capabilities = ["read", "list"] } to the bridge's policy`, configPath))
+		return
+	}
+
+	if secret == nil || secret.Data == nil {
+		report.Fail(check, fmt.Errorf("nothing under %s", configPath),
+			fmt.Sprintf("write an entry for each application, e.g. vault write %s/<stack>/<service> policies=default", configPath))
+		return
+	}
+
+	keys, _ := secret.Data["keys"].([]interface{})
+	report.Pass(check, fmt.Sprintf("%s is readable, %d entries", configPath, len(keys)))
+}
+
+func checkRancher(report *doctor.Report, env EnvironmentConfig) {
+	check := "Rancher credentials (" + environmentName(env) + ")"
+
+	if env.RancherURL == "" || env.RancherAccessKey == "" || env.RancherSecretKey == "" {
+		report.Fail(check, errors.New("URL or API keys missing"), "set --rancher-url, --rancher-access and --rancher-secret")
+		return
+	}
+
+	verifierConfig := verifier.NewConfig(env.RancherURL, env.RancherAccessKey, env.RancherSecretKey)
+	verifierConfig.EnvironmentName = env.Name
+
+	project, visible, err := verifier.CheckAPIKey(verifierConfig)
+	if err != nil {
+		report.Fail(check, err, "use an environment API key of the environment served, created under API > Keys in Rancher")
+		return
+	}
+
+	if visible > 1 {
+		report.Pass(check, fmt.Sprintf("environment %s, the key can see %d environments, an environment API key would be enough", project.Name, visible))
+		return
+	}
+
+	report.Pass(check, "environment "+project.Name)
+}
+
+func hasCapability(capabilities []string, wanted ...string) bool {
+	for _, capability := range capabilities {
+		for _, w := range wanted {
+			if capability == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func environmentName(env EnvironmentConfig) string {
+	if env.Name == "" {
+		return "default"
+	}
+	return env.Name
+}
@@ -0,0 +1,144 @@
+package bridge
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var leaseMetrics = expvar.NewMap("leases")
+
+// leaseManager renews app tokens while agents report their containers running.
+type leaseManager struct {
+	ledger   *issuanceLedger
+	liveness time.Duration
+}
+
+func newLeaseManager(ledger *issuanceLedger, liveness time.Duration) *leaseManager {
+	return &leaseManager{
+		ledger:   ledger,
+		liveness: liveness,
+	}
+}
+
+// Run renews due tokens every interval, forever.
+func (lm *leaseManager) Run(interval time.Duration) {
+	if interval <= 0 {
+		logrus.Info("Token renewal is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		lm.renew()
+	}
+}
+
+func (lm *leaseManager) renew() {
+	if err := lm.ledger.Sync(); err != nil {
+		logrus.Warnf("Can not sync issuances from the store: %s", err)
+	}
+
+	now := time.Now()
+
+	for _, issuance := range lm.ledger.Renewable(now, now.Add(-lm.liveness)) {
+		lm.renewIssuance(issuance, now)
+	}
+}
+
+func (lm *leaseManager) renewIssuance(issuance *Issuance, now time.Time) {
+	unlock := lm.ledger.Lock(issuance.Environment, issuance.Key)
+	defer unlock()
+
+	// another replica may have renewed or replaced it since the sync
+	current := lm.ledger.Active(issuance.Environment, issuance.Key)
+	if current == nil || current.PermAccessor != issuance.PermAccessor || current.Expires.After(issuance.Expires) {
+		return
+	}
+
+	env, err := actors.forEnvironment(issuance.Environment)
+	if err != nil {
+		logrus.Warnf("Can not renew token for %s: %s", issuance.Key, err)
+		return
+	}
+
+	increment := issuance.TTL
+	if !issuance.MaxExpires.IsZero() && now.Add(increment).After(issuance.MaxExpires) {
+		increment = issuance.MaxExpires.Sub(now)
+	}
+
+	ttl, err := env.secretStore.RenewToken(issuance.PermToken, int(increment.Seconds()))
+	if err != nil {
+		leaseMetrics.Add("renewal.failures", 1)
+		leaseAuditEvent("renew.failed", issuance, err)
+		return
+	}
+
+	leaseMetrics.Add("renewals", 1)
+	lm.ledger.Extend(issuance, now.Add(time.Duration(ttl)*time.Second))
+	leaseAuditEvent("renewed", issuance, nil)
+}
+
+// Heartbeat marks the tokens of the containers reported on hostID as in
+// use.
+func (lm *leaseManager) Heartbeat(environment, hostID string, containerIDs []string) {
+	lm.ledger.Seen(environment, hostID, containerIDs, time.Now())
+}
+
+// Release forgets a destroyed container, revoking its renewed token once unused.
+func (lm *leaseManager) Release(environment, hostID, containerID string) {
+	key, ok := lm.ledger.Find(environment, hostID, containerID)
+	if !ok {
+		// recorded by another replica since the last sync
+		if err := lm.ledger.Sync(); err != nil {
+			logrus.Warnf("Can not sync issuances from the store: %s", err)
+		}
+		if key, ok = lm.ledger.Find(environment, hostID, containerID); !ok {
+			return
+		}
+	}
+
+	unlock := lm.ledger.Lock(environment, key)
+	defer unlock()
+
+	lm.ledger.load(environment, key)
+	issuance := lm.ledger.Release(environment, hostID, containerID)
+	if issuance == nil || !issuance.Renew || !issuance.active(time.Now()) {
+		return
+	}
+
+	env, err := actors.forEnvironment(environment)
+	if err != nil {
+		logrus.Warnf("Can not revoke token for %s: %s", issuance.Key, err)
+		return
+	}
+
+	if err := env.secretStore.RevokeAccessor(issuance.PermAccessor); err != nil {
+		leaseMetrics.Add("revocation.failures", 1)
+		leaseAuditEvent("revoke.failed", issuance, err)
+		return
+	}
+
+	leaseMetrics.Add("revocations", 1)
+	leaseAuditEvent("revoked", issuance, nil)
+}
+
+func leaseAuditEvent(event string, issuance *Issuance, err error) {
+	fields := logrus.Fields{
+		"audit":       event,
+		"environment": issuance.Environment,
+		"issuance":    issuance.Key,
+		"path":        issuance.Path,
+	}
+
+	if err != nil {
+		fields["error"] = err.Error()
+		logrus.WithFields(fields).Warn("Secrets bridge audit")
+		return
+	}
+
+	logrus.WithFields(fields).Info("Secrets bridge audit")
+}
@@ -0,0 +1,383 @@
+package bridge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/secrets-bridge/vault"
+)
+
+// seenSaveInterval is how often a heartbeat is written to the store for an
+// issuance, the lease liveness is a few heartbeat intervals.
+const seenSaveInterval = time.Minute
+
+// Issuance is the app token a container, or every container of a pod, was
+// last handed.
+type Issuance struct {
+	Environment   string
+	Key           string
+	Path          string
+	PermToken     string
+	PermAccessor  string
+	RestartPolicy string
+	// Containers maps the containers holding the token to the Rancher host
+	// they run on, only that host's agent can report them.
+	Containers map[string]string
+	Issued     time.Time
+	Expires    time.Time
+
+	// Renewed issuances are kept alive by the lease manager while one of
+	// their containers was seen running, until MaxExpires when it is set.
+	Renew      bool
+	TTL        time.Duration
+	MaxExpires time.Time
+	Seen       time.Time
+
+	seenSaved time.Time
+}
+
+func (i *Issuance) active(now time.Time) bool {
+	return now.Before(i.Expires)
+}
+
+// issuanceLedger remembers the live issuance of every container and pod, in the store if set.
+type issuanceLedger struct {
+	mu      sync.Mutex
+	entries map[string]*Issuance
+	locks   map[string]*keyLock
+	store   vault.StateStore
+}
+
+// keyLock serialises the changes to one issuance, held across the Vault
+// calls between reading it and recording it again.
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newIssuanceLedger(store vault.StateStore) *issuanceLedger {
+	return &issuanceLedger{
+		entries: map[string]*Issuance{},
+		locks:   map[string]*keyLock{},
+		store:   store,
+	}
+}
+
+// Lock locks the issuance under key until the returned func is called.
+func (l *issuanceLedger) Lock(environment, key string) func() {
+	name := ledgerKey(environment, key)
+
+	l.mu.Lock()
+	lock, ok := l.locks[name]
+	if !ok {
+		lock = &keyLock{}
+		l.locks[name] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		l.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.mu.Unlock()
+	}
+}
+
+func ledgerKey(environment, key string) string {
+	return environment + "/" + key
+}
+
+// Active returns the issuance under key while its token is still valid.
+// The copy returned can be changed and recorded again.
+func (l *issuanceLedger) Active(environment, key string) *Issuance {
+	l.load(environment, key)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	issuance, ok := l.entries[ledgerKey(environment, key)]
+	if !ok || !issuance.active(time.Now()) {
+		return nil
+	}
+
+	return issuance.copy()
+}
+
+func (i *Issuance) copy() *Issuance {
+	c := *i
+	c.Containers = map[string]string{}
+	for id, hostID := range i.Containers {
+		c.Containers[id] = hostID
+	}
+	return &c
+}
+
+func (l *issuanceLedger) Record(issuance *Issuance) {
+	l.mu.Lock()
+	l.prune(time.Now())
+	issuance.seenSaved = issuance.Seen
+	l.entries[ledgerKey(issuance.Environment, issuance.Key)] = issuance
+	saved := issuance.copy()
+	l.mu.Unlock()
+
+	l.save(saved)
+}
+
+// Seen marks the issuances of the given containers on hostID as still in
+// use.
+func (l *issuanceLedger) Seen(environment, hostID string, containerIDs []string, now time.Time) {
+	l.mu.Lock()
+	unsaved := []*Issuance{}
+	for _, issuance := range l.entries {
+		if issuance.Environment != environment {
+			continue
+		}
+		for _, id := range containerIDs {
+			if recorded, ok := issuance.Containers[id]; ok && recorded == hostID {
+				issuance.Seen = now
+				if now.Sub(issuance.seenSaved) >= seenSaveInterval {
+					unsaved = append(unsaved, issuance)
+				}
+				break
+			}
+		}
+	}
+	l.mu.Unlock()
+
+	if l.store == nil {
+		return
+	}
+
+	for _, issuance := range unsaved {
+		l.saveSeen(issuance.Environment, issuance.Key, now)
+	}
+}
+
+// saveSeen writes a heartbeat to the store on top of what other replicas
+// recorded.
+func (l *issuanceLedger) saveSeen(environment, key string, now time.Time) {
+	unlock := l.Lock(environment, key)
+	defer unlock()
+
+	l.load(environment, key)
+
+	l.mu.Lock()
+	issuance, ok := l.entries[ledgerKey(environment, key)]
+	if !ok {
+		l.mu.Unlock()
+		return
+	}
+	if issuance.Seen.Before(now) {
+		issuance.Seen = now
+	}
+	issuance.seenSaved = now
+	saved := issuance.copy()
+	l.mu.Unlock()
+
+	l.save(saved)
+}
+
+// Find returns the key of the issuance holding a container on hostID.
+func (l *issuanceLedger) Find(environment, hostID, containerID string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, issuance := range l.entries {
+		if recorded, ok := issuance.Containers[containerID]; issuance.Environment == environment && ok && recorded == hostID {
+			return issuance.Key, true
+		}
+	}
+
+	return "", false
+}
+
+// Release forgets a container on hostID that went away. The issuance is
+// returned once its last container is gone.
+func (l *issuanceLedger) Release(environment, hostID, containerID string) *Issuance {
+	l.mu.Lock()
+	for key, issuance := range l.entries {
+		if recorded, ok := issuance.Containers[containerID]; issuance.Environment != environment || !ok || recorded != hostID {
+			continue
+		}
+
+		delete(issuance.Containers, containerID)
+		if len(issuance.Containers) > 0 {
+			saved := issuance.copy()
+			l.mu.Unlock()
+
+			l.save(saved)
+			return nil
+		}
+
+		delete(l.entries, key)
+		l.mu.Unlock()
+
+		l.forget(environment, issuance.Key)
+		return issuance
+	}
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Renewable returns the renewed issuances that expire within half their
+// TTL and were seen since the given time.
+func (l *issuanceLedger) Renewable(now, seenSince time.Time) []*Issuance {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	renewable := []*Issuance{}
+	for _, issuance := range l.entries {
+		if !issuance.Renew || !issuance.active(now) || issuance.Seen.Before(seenSince) {
+			continue
+		}
+		if !issuance.MaxExpires.IsZero() && !issuance.Expires.Before(issuance.MaxExpires) {
+			continue
+		}
+		if issuance.Expires.Sub(now) > issuance.TTL/2 {
+			continue
+		}
+		renewable = append(renewable, issuance.copy())
+	}
+
+	return renewable
+}
+
+// Extend records a renewal, unless the issuance was replaced meanwhile.
+func (l *issuanceLedger) Extend(issuance *Issuance, expires time.Time) {
+	l.mu.Lock()
+	current, ok := l.entries[ledgerKey(issuance.Environment, issuance.Key)]
+	if !ok || current.PermAccessor != issuance.PermAccessor {
+		l.mu.Unlock()
+		return
+	}
+	current.Expires = expires
+	saved := current.copy()
+	l.mu.Unlock()
+
+	l.save(saved)
+}
+
+func (l *issuanceLedger) prune(now time.Time) {
+	for key, issuance := range l.entries {
+		if !issuance.active(now) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// Sync replaces the ledger with what is in the store, dropping expired
+// issuances from it.
+func (l *issuanceLedger) Sync() error {
+	if l.store == nil {
+		return nil
+	}
+
+	names, err := l.store.ListState()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entries := map[string]*Issuance{}
+	for _, name := range names {
+		issuance, err := l.read(name)
+		if err != nil {
+			return err
+		}
+		if issuance == nil {
+			continue
+		}
+		if !issuance.active(now) {
+			if err := l.store.DeleteState(name); err != nil {
+				logrus.Warnf("Can not delete expired issuance %s: %s", issuance.Key, err)
+			}
+			continue
+		}
+		entries[ledgerKey(issuance.Environment, issuance.Key)] = issuance
+	}
+
+	l.mu.Lock()
+	l.entries = entries
+	l.mu.Unlock()
+
+	return nil
+}
+
+func stateName(environment, key string) string {
+	sum := sha256.Sum256([]byte(ledgerKey(environment, key)))
+	return "ledger-" + hex.EncodeToString(sum[:])
+}
+
+func (l *issuanceLedger) read(name string) (*Issuance, error) {
+	data, err := l.store.LoadState(name)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	issuance := &Issuance{}
+	if err := json.Unmarshal(data, issuance); err != nil {
+		return nil, err
+	}
+	issuance.seenSaved = issuance.Seen
+
+	return issuance, nil
+}
+
+// load refreshes the issuance under key from the store, keeping what is in
+// memory when the store can't be read.
+func (l *issuanceLedger) load(environment, key string) {
+	if l.store == nil {
+		return
+	}
+
+	issuance, err := l.read(stateName(environment, key))
+	if err != nil {
+		logrus.Warnf("Can not read issuance %s from the store: %s", key, err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if issuance == nil {
+		delete(l.entries, ledgerKey(environment, key))
+		return
+	}
+	l.entries[ledgerKey(environment, key)] = issuance
+}
+
+func (l *issuanceLedger) save(issuance *Issuance) {
+	if l.store == nil {
+		return
+	}
+
+	data, err := json.Marshal(issuance)
+	if err == nil {
+		err = l.store.SaveState(stateName(issuance.Environment, issuance.Key), data)
+	}
+	if err != nil {
+		logrus.Warnf("Can not write issuance %s to the store: %s", issuance.Key, err)
+	}
+}
+
+func (l *issuanceLedger) forget(environment, key string) {
+	if l.store == nil {
+		return
+	}
+
+	if err := l.store.DeleteState(stateName(environment, key)); err != nil {
+		logrus.Warnf("Can not delete issuance %s from the store: %s", key, err)
+	}
+}
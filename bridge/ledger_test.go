@@ -0,0 +1,159 @@
+package bridge
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore is a vault.StateStore in memory.
+type memoryStore struct {
+	mu    sync.Mutex
+	state map[string][]byte
+}
+
+func (s *memoryStore) LoadState(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state[name], nil
+}
+
+func (s *memoryStore) SaveState(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state[name] = data
+	return nil
+}
+
+func (s *memoryStore) DeleteState(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.state, name)
+	return nil
+}
+
+func (s *memoryStore) ListState() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := []string{}
+	for name := range s.state {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func TestIssuanceLedgerRelease(t *testing.T) {
+	tests := []struct {
+		name       string
+		containers map[string]string
+		hostID     string
+		container  string
+		left       int
+	}{
+		{"last container", map[string]string{"c1": "h1"}, "h1", "c1", 0},
+		{"one of two", map[string]string{"c1": "h1", "c2": "h2"}, "h1", "c1", 1},
+		{"other host", map[string]string{"c1": "h1"}, "h2", "c1", 1},
+		{"unknown container", map[string]string{"c1": "h1"}, "h1", "c2", 1},
+	}
+
+	for _, test := range tests {
+		store := &memoryStore{state: map[string][]byte{}}
+		ledger := newIssuanceLedger(store)
+		ledger.Record(&Issuance{Environment: "dev", Key: "a", Containers: test.containers, Expires: time.Now().Add(time.Hour)})
+
+		released := ledger.Release("dev", test.hostID, test.container)
+		if (released != nil) != (test.left == 0) {
+			t.Errorf("%s: released is %v", test.name, released)
+		}
+
+		// a restarted bridge must see the same
+		for _, l := range []*issuanceLedger{ledger, newIssuanceLedger(store)} {
+			active := l.Active("dev", "a")
+			switch {
+			case test.left == 0 && active != nil:
+				t.Errorf("%s: issuance still active with %v", test.name, active.Containers)
+			case test.left != 0 && (active == nil || len(active.Containers) != test.left):
+				t.Errorf("%s: issuance is %v, want %d containers left", test.name, active, test.left)
+			}
+		}
+	}
+}
+
+func TestIssuanceLedgerRenewable(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		issuance Issuance
+		want     bool
+	}{
+		{"due", Issuance{Renew: true, TTL: time.Hour, Seen: now, Expires: now.Add(10 * time.Minute)}, true},
+		{"not renewed", Issuance{TTL: time.Hour, Seen: now, Expires: now.Add(10 * time.Minute)}, false},
+		{"not seen", Issuance{Renew: true, TTL: time.Hour, Seen: now.Add(-time.Hour), Expires: now.Add(10 * time.Minute)}, false},
+		{"more than half left", Issuance{Renew: true, TTL: time.Hour, Seen: now, Expires: now.Add(45 * time.Minute)}, false},
+		{"at max", Issuance{Renew: true, TTL: time.Hour, Seen: now, Expires: now.Add(10 * time.Minute), MaxExpires: now.Add(10 * time.Minute)}, false},
+	}
+
+	for _, test := range tests {
+		issuance := test.issuance
+		issuance.Environment, issuance.Key, issuance.Containers = "dev", "a", map[string]string{"c1": "h1"}
+
+		ledger := newIssuanceLedger(nil)
+		ledger.Record(&issuance)
+
+		if renewable := ledger.Renewable(now, now.Add(-time.Minute)); (len(renewable) == 1) != test.want {
+			t.Errorf("%s: renewable is %v, want %t", test.name, renewable, test.want)
+		}
+	}
+}
+
+func TestIssuanceLedgerSync(t *testing.T) {
+	now := time.Now()
+	store := &memoryStore{state: map[string][]byte{}}
+
+	first := newIssuanceLedger(store)
+	first.Record(&Issuance{Environment: "dev", Key: "live", Containers: map[string]string{"c1": "h1"}, Expires: now.Add(time.Hour)})
+	first.Record(&Issuance{Environment: "dev", Key: "expired", Containers: map[string]string{"c2": "h1"}, Expires: now.Add(-time.Second)})
+
+	second := newIssuanceLedger(store)
+	if err := second.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := second.Find("dev", "h1", "c1"); !ok {
+		t.Error("synced ledger is missing the live issuance")
+	}
+	if _, ok := second.Find("dev", "h1", "c2"); ok {
+		t.Error("synced ledger kept the expired issuance")
+	}
+	if _, ok := store.state[stateName("dev", "expired")]; ok {
+		t.Error("expired issuance is still in the store")
+	}
+}
+
+func TestIssuanceLedgerLock(t *testing.T) {
+	ledger := newIssuanceLedger(nil)
+
+	unlock := ledger.Lock("dev", "a")
+	locked := make(chan struct{})
+	go func() {
+		defer close(locked)
+		ledger.Lock("dev", "a")()
+	}()
+
+	// another key is independent
+	ledger.Lock("dev", "b")()
+
+	select {
+	case <-locked:
+		t.Fatal("the same key was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the key was not unlocked")
+	}
+}
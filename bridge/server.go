@@ -1,13 +1,20 @@
 package bridge
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
+	"github.com/rancher/secrets-bridge/metrics"
 	"github.com/rancher/secrets-bridge/types"
 	"github.com/rancher/secrets-bridge/vault"
 	"github.com/rancher/secrets-bridge/verifier"
@@ -16,18 +23,42 @@ import (
 
 const default_verifier string = "rancher"
 
+// destroyWait is how long a destroy event waits for Rancher to report the
+// container removed.
+const destroyWait = 10 * time.Second
+
+// maxRequestBody caps what is read of an agent's request.
+const maxRequestBody = 1 << 20
+
 var actors *serverActors
 
 type serverActors struct {
-	verifier     verifier.Verifier
-	secretStore  vault.SecureStore
+	environments map[string]*environmentActors
 	authVerifier verifier.AuthVerifier
+	ledger       *issuanceLedger
+	leases       *leaseManager
+}
+
+type environmentActors struct {
+	verifier    verifier.Verifier
+	secretStore vault.SecureStore
 }
 
 type SecretResponse struct {
-	ExternalID string `json:"externalId"`
-	TempToken  string `json:"tempToken"`
-	CubbyPath  string `json:"cubbyPath"`
+	ExternalID string    `json:"externalId"`
+	TempToken  string    `json:"tempToken"`
+	CubbyPath  string    `json:"cubbyPath"`
+	VaultAddr  string    `json:"vaultAddr"`
+	CABundle   string    `json:"caBundle,omitempty"`
+	TTL        int       `json:"ttl"`
+	Expires    time.Time `json:"expires"`
+}
+
+// HealthResponse tells agents, and secrets-bridge doctor, how their
+// requests are checked.
+type HealthResponse struct {
+	SignatureVerified bool   `json:"signatureVerified"`
+	MaxClockSkew      string `json:"maxClockSkew"`
 }
 
 type Error interface {
@@ -48,19 +79,29 @@ func (se *StatusError) Status() int {
 	return se.Code
 }
 
-func HTTPHandlerWrapper(t func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+func HTTPHandlerWrapper(t func(http.ResponseWriter, *http.Request, *verifier.AgentAuth) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logrus.Debugf("Processing Request")
 		defer logrus.Debugf("Finished Processing Request")
 
 		header, _ := base64.StdEncoding.DecodeString(r.Header.Get("X-Agent-Signature"))
 
-		verifiedAuth, err := actors.authVerifier.VerifyAuth(string(header))
-		if err != nil || !verifiedAuth {
+		// the signature covers the body, so it is read before anything else
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBody))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		auth, err := actors.authVerifier.VerifyAuth(string(header), r.Method, r.URL.Path, body)
+		if err != nil {
+			logrus.Warnf("Rejected request from %s: %s", r.RemoteAddr, err)
 			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
 		}
 
-		if err := t(w, r); err != nil {
+		if err := t(w, r, auth); err != nil {
 			switch e := err.(type) {
 			case Error:
 				http.Error(w, e.Error(), e.Status())
@@ -81,6 +122,18 @@ func StartServer(c *cli.Context) {
 
 	r := mux.NewRouter()
 	r.HandleFunc("/v1/message", HTTPHandlerWrapper(messageHandler)).Methods("POST")
+	r.HandleFunc("/v1/heartbeat", HTTPHandlerWrapper(heartbeatHandler)).Methods("POST")
+	r.Handle("/v1/health", healthHandler(&HealthResponse{
+		SignatureVerified: c.String("agent-signing-key") != "",
+		MaxClockSkew:      c.Duration("max-clock-skew").String(),
+	})).Methods("GET")
+
+	if c.String("agent-signing-key") == "" {
+		logrus.Warn("No --agent-signing-key set, agent signatures are not verified and heartbeats and destroy events are refused")
+	}
+
+	go actors.leases.Run(c.Duration("lease-interval"))
+	go metrics.Serve(c.String("metrics-listen"), "topologyCache", "leases")
 
 	logrus.Infof("Listening on port: 8181")
 	s := &http.Server{
@@ -93,28 +146,23 @@ func StartServer(c *cli.Context) {
 }
 
 func initActors(c *cli.Context) (*serverActors, error) {
-	verifierConfig := verifier.NewConfig(
-		c.String("rancher-url"),
-		c.String("rancher-access"),
-		c.String("rancher-secret"))
-
-	rVerify, err := verifier.NewVerifier(default_verifier, verifierConfig)
+	config, err := loadServerConfig(c)
 	if err != nil {
-		logrus.Fatalf("Can not get verifier client")
 		return nil, err
 	}
 
-	aVerify, err := verifier.NewAuthVerifier(default_verifier, verifierConfig)
+	pathTemplates, err := buildPathTemplates(c)
 	if err != nil {
-		logrus.Fatalf("Can not get verifier client")
 		return nil, err
 	}
 
 	secretStoreConfig := map[string]interface{}{
-		"vault-token":     c.String("vault-token"),
-		"vault-url":       c.String("vault-url"),
-		"vault-cacert":    c.String("vault-cacert"),
-		"vault-cubbypath": c.String("vault-cubbypath"),
+		"vault-token":            c.String("vault-token"),
+		"vault-url":              c.String("vault-url"),
+		"vault-cacert":           c.String("vault-cacert"),
+		"vault-advertise-cacert": c.String("vault-advertise-cacert"),
+		"vault-cubbypath":        c.String("vault-cubbypath"),
+		"require-token-role":     c.Bool("require-token-role"),
 	}
 
 	sStore, err := vault.NewSecureStore(secretStoreConfig)
@@ -123,15 +171,112 @@ func initActors(c *cli.Context) (*serverActors, error) {
 		return nil, err
 	}
 
-	return &serverActors{
-		verifier:     rVerify,
-		secretStore:  sStore,
-		authVerifier: aVerify,
-	}, nil
+	store, _ := sStore.(vault.StateStore)
+	ledger := newIssuanceLedger(store)
+	if err := ledger.Sync(); err != nil {
+		logrus.Warnf("Can not read issuances from Vault, tokens issued before the restart are not known: %s", err)
+	}
 
+	sActors := &serverActors{
+		environments: map[string]*environmentActors{},
+		ledger:       ledger,
+		leases:       newLeaseManager(ledger, c.Duration("lease-liveness")),
+	}
+
+	for _, env := range config.Environments {
+		verifierConfig := verifier.NewConfig(
+			env.RancherURL,
+			env.RancherAccessKey,
+			env.RancherSecretKey)
+		verifierConfig.EnvironmentName = env.Name
+		verifierConfig.CacheTTL = c.Duration("rancher-cache-ttl")
+		verifierConfig.PathTemplates = pathTemplates
+		verifierConfig.AgentSigningKey = c.String("agent-signing-key")
+		verifierConfig.MaxClockSkew = c.Duration("max-clock-skew")
+
+		rVerify, err := verifier.NewVerifier(default_verifier, verifierConfig)
+		if err != nil {
+			logrus.Fatalf("Can not get verifier client for environment %s: %s", env.Name, err)
+			return nil, err
+		}
+
+		if sActors.authVerifier == nil {
+			sActors.authVerifier, err = verifier.NewAuthVerifier(default_verifier, verifierConfig)
+			if err != nil {
+				logrus.Fatalf("Can not get verifier client")
+				return nil, err
+			}
+		}
+
+		logrus.Infof("Serving environment: %s", env.Name)
+		sActors.environments[env.Name] = &environmentActors{
+			verifier:    rVerify,
+			secretStore: sStore.ForEnvironment(env.VaultConfigPath, env.TokenRole),
+		}
+	}
+
+	return sActors, nil
 }
 
-func messageHandler(w http.ResponseWriter, r *http.Request) error {
+// forAgent returns the environment the agent runs in and its host there.
+func (sa *serverActors) forAgent(uuid, reported string) (string, *environmentActors, string, error) {
+	names := []string{}
+	for name := range sa.environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		env := sa.environments[name]
+		hostID, err := env.verifier.AgentHost(uuid)
+		if err != nil {
+			logrus.Debugf("Agent %s is not in environment %s: %s", uuid, name, err)
+			continue
+		}
+
+		if name != "" && reported != name {
+			return "", nil, "", fmt.Errorf("Agent %s runs in environment %s, not %s", uuid, name, reported)
+		}
+		return name, env, hostID, nil
+	}
+
+	return "", nil, "", fmt.Errorf("Agent %s is not in an environment served by this bridge", uuid)
+}
+
+// forEnvironment returns the environment an issuance was recorded in.
+func (sa *serverActors) forEnvironment(name string) (*environmentActors, error) {
+	if env, ok := sa.environments[name]; ok {
+		return env, nil
+	}
+
+	if env, ok := sa.environments[""]; ok {
+		return env, nil
+	}
+
+	return nil, fmt.Errorf("Environment %s is not served by this bridge", name)
+}
+
+func buildPathTemplates(c *cli.Context) (*verifier.PathTemplates, error) {
+	cattle, err := verifier.NewPathTemplate(c.String("cattle-path-template"))
+	if err != nil {
+		return nil, err
+	}
+
+	k8s, err := verifier.NewPathTemplate(c.String("k8s-path-template"))
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Cattle Vault path template: %s", cattle)
+	logrus.Infof("Kubernetes Vault path template: %s", k8s)
+
+	return &verifier.PathTemplates{
+		Cattle:     cattle,
+		Kubernetes: k8s,
+	}, nil
+}
+
+func messageHandler(w http.ResponseWriter, r *http.Request, auth *verifier.AgentAuth) error {
 	var response *SecretResponse
 
 	decoder := json.NewDecoder(r.Body)
@@ -144,9 +289,9 @@ func messageHandler(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	logrus.Debugf("MSG Decoded: %#v", t)
-	if t.Action == "start" && t.UUID != "" {
-		logrus.Debugf("Received start event for container UUID: %s", t.UUID)
-		if response, err = ContainerStart(w, t); err != nil {
+	if (t.Action == "start" || t.Action == "create") && t.UUID != "" {
+		logrus.Debugf("Received %s event for container UUID: %s", t.Action, t.UUID)
+		if response, err = ContainerStart(w, t, auth); err != nil {
 			logrus.Errorf("Unverified: %s", err)
 			return &StatusError{http.StatusNotFound, err}
 		}
@@ -157,7 +302,66 @@ func messageHandler(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	return &StatusError{http.StatusNotImplemented, nil}
+	if t.Action == "destroy" && t.Event != nil {
+		logrus.Debugf("Received destroy event for container: %s", t.Event.ID)
+		return destroyHandler(w, t, auth)
+	}
+
+	return &StatusError{http.StatusNotImplemented, errors.New("Unsupported action: " + t.Action)}
+}
+
+// destroyHandler releases a container once Rancher reports it removed, and
+// only when the agent reporting it runs on the container's host.
+func destroyHandler(w http.ResponseWriter, t *types.Message, auth *verifier.AgentAuth) error {
+	if !auth.Signed {
+		return &StatusError{http.StatusForbidden, errors.New("Destroy events are refused without --agent-signing-key")}
+	}
+
+	environment, env, hostID, err := actors.forAgent(auth.UUID, t.Environment)
+	if err != nil {
+		return &StatusError{http.StatusForbidden, err}
+	}
+
+	gone, err := env.verifier.ContainerGone(t.Event.ID, destroyWait)
+	if err != nil {
+		return err
+	}
+	if !gone {
+		return &StatusError{http.StatusConflict, fmt.Errorf("Container %s is not removed in Rancher", t.Event.ID)}
+	}
+
+	actors.leases.Release(environment, hostID, t.Event.ID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func heartbeatHandler(w http.ResponseWriter, r *http.Request, auth *verifier.AgentAuth) error {
+	if !auth.Signed {
+		return &StatusError{http.StatusForbidden, errors.New("Heartbeats are refused without --agent-signing-key")}
+	}
+
+	heartbeat := &types.Heartbeat{}
+	if err := json.NewDecoder(r.Body).Decode(heartbeat); err != nil {
+		return &StatusError{http.StatusBadRequest, err}
+	}
+
+	environment, _, hostID, err := actors.forAgent(auth.UUID, heartbeat.Environment)
+	if err != nil {
+		return &StatusError{http.StatusForbidden, err}
+	}
+
+	logrus.Debugf("Heartbeat from %s with %d containers", heartbeat.Host, len(heartbeat.Containers))
+	actors.leases.Heartbeat(environment, hostID, heartbeat.Containers)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func healthHandler(health *HealthResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		json.NewEncoder(w).Encode(health)
+	}
 }
 
 func jsonSuccessResponse(body *SecretResponse, w http.ResponseWriter) {
@@ -167,18 +371,27 @@ func jsonSuccessResponse(body *SecretResponse, w http.ResponseWriter) {
 	return
 }
 
-func ContainerStart(w http.ResponseWriter, msg *types.Message) (*SecretResponse, error) {
-	var tempKey string
+func ContainerStart(w http.ResponseWriter, msg *types.Message, auth *verifier.AgentAuth) (*SecretResponse, error) {
+	tempKey := &vault.SecretKey{}
 
-	verifiedObj, err := actors.verifier.Verify(msg)
+	environment, env, _, err := actors.forAgent(auth.UUID, msg.Environment)
 	if err != nil {
+		auditEvent("verification.failed", msg, nil, err)
+		return &SecretResponse{}, err
+	}
+	msg.Environment = environment
+
+	verifiedObj, err := env.verifier.Verify(msg)
+	if err != nil {
+		auditEvent("verification.failed", msg, nil, err)
 		return &SecretResponse{}, err
 	}
 
 	if verifiedObj.Verified() {
 		logrus.Debugf("Verified")
-		tempKey, err = actors.secretStore.CreateSecretKey(verifiedObj)
+		tempKey, err = issue(env, msg, verifiedObj)
 		if err != nil {
+			auditEvent("issue.failed", msg, verifiedObj, err)
 			return &SecretResponse{}, err
 		}
 	}
@@ -186,13 +399,121 @@ func ContainerStart(w http.ResponseWriter, msg *types.Message) (*SecretResponse,
 	logrus.Debugf("VerifiedObj: %#v", verifiedObj)
 	logrus.Debugf("VerifiedObj Path: %s", verifiedObj.Path())
 	logrus.Debugf("VerifiedObj ID: %s", verifiedObj.ID())
-	logrus.Debugf("TempKey ID: %s", tempKey)
+	logrus.Debugf("TempKey ID: %s", tempKey.Token)
 
 	// ToDo: get a verified container object
 	// This is not very generic...
 	return &SecretResponse{
-		TempToken:  tempKey,
+		TempToken:  tempKey.Token,
 		ExternalID: verifiedObj.ID(),
-		CubbyPath:  actors.secretStore.GetSecretStoreURL() + "/cubbyhole/" + verifiedObj.Path(),
+		CubbyPath:  env.secretStore.GetSecretStoreURL() + "/cubbyhole/" + verifiedObj.Path(),
+		VaultAddr:  env.secretStore.GetAddress(),
+		CABundle:   env.secretStore.GetCABundle(),
+		TTL:        tempKey.TTL,
+		Expires:    time.Now().Add(time.Duration(tempKey.TTL) * time.Second).UTC(),
 	}, nil
 }
+
+// issue hands the container a token, shared by a pod and reused per restart_policy.
+func issue(env *environmentActors, msg *types.Message, verifiedObj verifier.VerifiedResponse) (*vault.SecretKey, error) {
+	containerID := verifiedObj.ID()
+	entryKey := issuanceKey(msg, verifiedObj)
+
+	unlock := actors.ledger.Lock(msg.Environment, entryKey)
+	defer unlock()
+
+	previous := actors.ledger.Active(msg.Environment, entryKey)
+
+	var key *vault.SecretKey
+	var err error
+
+	switch {
+	case previous == nil:
+		key, err = env.secretStore.CreateSecretKey(verifiedObj)
+		if err != nil {
+			return nil, err
+		}
+		auditEvent("issued", msg, verifiedObj, nil)
+	case previous.Path == verifiedObj.Path() &&
+		(previous.Containers[containerID] == "" || len(previous.Containers) > 1 || previous.RestartPolicy == vault.RestartPolicyReuse):
+		key, err = env.secretStore.ReissueSecretKey(verifiedObj, previous.PermToken)
+		if err != nil {
+			return nil, err
+		}
+		auditEvent("reissued", msg, verifiedObj, nil)
+	default:
+		if err := env.secretStore.RevokeAccessor(previous.PermAccessor); err != nil {
+			auditEvent("revoke.failed", msg, verifiedObj, err)
+		} else {
+			auditEvent("revoked", msg, verifiedObj, nil)
+		}
+		previous = nil
+		key, err = env.secretStore.CreateSecretKey(verifiedObj)
+		if err != nil {
+			return nil, err
+		}
+		auditEvent("issued", msg, verifiedObj, nil)
+	}
+
+	if previous == nil {
+		now := time.Now()
+		previous = &Issuance{
+			Environment:   msg.Environment,
+			Key:           entryKey,
+			Path:          verifiedObj.Path(),
+			PermToken:     key.PermToken,
+			PermAccessor:  key.PermAccessor,
+			RestartPolicy: key.RestartPolicy,
+			Containers:    map[string]string{},
+			Issued:        now,
+			Expires:       now.Add(time.Duration(key.PermTTL) * time.Second),
+			Renew:         key.Renew,
+			TTL:           time.Duration(key.PermTTL) * time.Second,
+		}
+		if key.Renew && key.MaxTTL > 0 {
+			previous.MaxExpires = now.Add(time.Duration(key.MaxTTL) * time.Second)
+		}
+	}
+	previous.Containers[containerID] = verifiedObj.HostID()
+	previous.Seen = time.Now()
+	actors.ledger.Record(previous)
+
+	return key, nil
+}
+
+// issuanceKey is the pod and config path for Kubernetes containers, the container otherwise.
+func issuanceKey(msg *types.Message, verifiedObj verifier.VerifiedResponse) string {
+	if msg.ContainerType == "kubernetes" && msg.Event != nil {
+		if podUID := msg.Event.Actor.Attributes["io.kubernetes.pod.uid"]; podUID != "" {
+			return "pod/" + podUID + "/" + verifiedObj.Path()
+		}
+	}
+	return verifiedObj.ID()
+}
+
+func auditEvent(event string, msg *types.Message, verifiedObj verifier.VerifiedResponse, err error) {
+	fields := logrus.Fields{
+		"audit":         event,
+		"uuid":          msg.UUID,
+		"host":          msg.Host,
+		"containerType": msg.ContainerType,
+		"environment":   msg.Environment,
+	}
+
+	if msg.Restart {
+		fields["restart"] = true
+	}
+
+	if verifiedObj != nil {
+		fields["externalId"] = verifiedObj.ID()
+		fields["path"] = verifiedObj.Path()
+	}
+
+	if err != nil {
+		fields["error"] = err.Error()
+		logrus.WithFields(fields).Warn("Secrets bridge audit")
+		return
+	}
+
+	logrus.WithFields(fields).Info("Secrets bridge audit")
+}
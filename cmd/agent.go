@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/rancher/secrets-bridge/agent"
 	"github.com/urfave/cli"
 )
@@ -10,16 +12,137 @@ func AgentCommand() cli.Command {
 		Name:   "agent",
 		Usage:  "Start listening agent on docker host",
 		Action: agent.StartAgent,
-		Flags: []cli.Flag{
+		Subcommands: []cli.Command{
+			{
+				Name:      "inject",
+				Usage:     "Issue and deliver credentials to one container",
+				ArgsUsage: "<container-id>",
+				Action:    agent.InjectContainer,
+				Flags: append(agentFlags(),
+					cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Show the message and where it would be delivered without calling the bridge",
+					},
+				),
+			},
+		},
+		Flags: append(agentFlags(),
+			cli.BoolFlag{
+				Name:  "deliver-on-create",
+				Usage: "Deliver credentials when a container is created, before its entrypoint runs",
+			},
+			cli.IntFlag{
+				Name:  "workers",
+				Value: 10,
+				Usage: "Number of container events handled concurrently",
+			},
+			cli.IntFlag{
+				Name:  "queue-size",
+				Value: 100,
+				Usage: "Number of container events buffered while all workers are busy",
+			},
+			cli.BoolTFlag{
+				Name:  "reconcile",
+				Usage: "Hand credentials to running containers that never got them when the agent starts",
+			},
+			cli.DurationFlag{
+				Name:  "reconcile-interval",
+				Usage: "Also reconcile running containers on this interval, 0 reconciles only at startup",
+			},
+			cli.DurationFlag{
+				Name:  "reconcile-rate",
+				Value: 200 * time.Millisecond,
+				Usage: "Minimum delay between containers handled by a reconcile pass",
+			},
+			cli.DurationFlag{
+				Name:  "retry-window",
+				Value: 270 * time.Second,
+				Usage: "How long after a container starts failed deliveries to it are retried, at most the temp token TTL",
+			},
 			cli.StringFlag{
-				Name:  "metadata-url",
-				Value: "http://rancher-metadata/2015-12-19",
-				Usage: "Sets the metadata variable",
+				Name:  "local-api",
+				Usage: "Serve credentials to local containers on unix:///path/to.sock or host:port",
 			},
 			cli.StringFlag{
-				Name:  "bridge-url",
-				Usage: "Secrets Bridge endpoint",
+				Name:  "metrics-listen",
+				Value: "127.0.0.1:8183",
+				Usage: "Address the delivery hook counters are served on at /debug/vars, empty turns it off",
 			},
+			cli.DurationFlag{
+				Name:  "heartbeat-interval",
+				Value: time.Minute,
+				Usage: "How often running containers are reported to the bridge to keep their tokens renewed, 0 disables it",
+			},
+		),
+	}
+}
+
+// agentFlags are shared by the agent and the commands acting for it.
+func agentFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "metadata-url",
+			Value: "http://rancher-metadata/2015-12-19",
+			Usage: "Sets the metadata variable",
+		},
+		cli.StringFlag{
+			Name:  "runtime",
+			Value: "docker",
+			Usage: "Container runtime to watch, docker or containerd",
+		},
+		cli.StringFlag{
+			Name:   "docker-host",
+			Value:  "unix:///var/run/docker.sock",
+			Usage:  "Docker daemon to connect to",
+			EnvVar: "DOCKER_HOST",
+		},
+		cli.BoolFlag{
+			Name:   "docker-tls-verify",
+			Usage:  "Use TLS and verify the Docker daemon's certificate",
+			EnvVar: "DOCKER_TLS_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "docker-cert-path",
+			Usage:  "Directory with ca.pem, cert.pem and key.pem for TLS to the Docker daemon",
+			EnvVar: "DOCKER_CERT_PATH",
+		},
+		cli.StringFlag{
+			Name:   "docker-api-version",
+			Usage:  "Docker API version to use instead of negotiating it with the daemon",
+			EnvVar: "DOCKER_API_VERSION",
+		},
+		cli.StringFlag{
+			Name:  "containerd-address",
+			Value: "/run/containerd/containerd.sock",
+			Usage: "containerd socket, for --runtime containerd",
+		},
+		cli.StringFlag{
+			Name:  "containerd-namespace",
+			Value: "k8s.io",
+			Usage: "containerd namespace to watch, for --runtime containerd",
+		},
+		cli.StringFlag{
+			Name:  "containerd-ctr",
+			Value: "ctr",
+			Usage: "Path to the ctr client, for --runtime containerd",
+		},
+		cli.StringFlag{
+			Name:  "bridge-url",
+			Usage: "Secrets Bridge endpoint",
+		},
+		cli.StringFlag{
+			Name:  "environment",
+			Usage: "Rancher environment name sent to the bridge, defaults to the one in metadata",
+		},
+		cli.StringFlag{
+			Name:  "state-dir",
+			Value: "/var/lib/secrets-bridge",
+			Usage: "Directory the agent keeps its state in across restarts",
+		},
+		cli.StringFlag{
+			Name:  "volume-dir",
+			Value: "/var/lib/secrets-bridge/volumes",
+			Usage: "Host directory, mounted as a tmpfs, holding the volumes of containers using the volume writer",
 		},
 	}
 }
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"github.com/rancher/secrets-bridge/bridge"
+	"github.com/urfave/cli"
+)
+
+func BootstrapCommand() cli.Command {
+	return cli.Command{
+		Name:   "bootstrap",
+		Usage:  "Provisions Vault for a Secrets Bridge server and prints how to start it",
+		Action: bridge.Bootstrap,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "vault-url",
+				Value:  "http://127.0.0.1:8200",
+				Usage:  "URL to Vault server",
+				EnvVar: "VAULT_ADDR",
+			},
+			cli.StringFlag{
+				Name:   "vault-token",
+				Usage:  "Admin Vault token allowed to write policies, token roles and tokens",
+				EnvVar: "VAULT_TOKEN",
+			},
+			cli.StringFlag{
+				Name:   "vault-cacert",
+				Usage:  "CA Pem to use to communicate with Vault",
+				EnvVar: "VAULT_CA_CERT",
+			},
+			cli.StringFlag{
+				Name:  "environment",
+				Value: "Default",
+				Usage: "Rancher environment the server is for",
+			},
+			cli.StringFlag{
+				Name:  "config-path",
+				Usage: "Vault path applications are configured under, defaults to secret/secrets-bridge/<environment>",
+			},
+			cli.StringFlag{
+				Name:  "policy",
+				Usage: "Name of the bridge's policy, defaults to grantor-<environment>",
+			},
+			cli.StringFlag{
+				Name:  "token-role",
+				Usage: "Token role the bridge creates tokens with, defaults to the policy name",
+			},
+			cli.StringFlag{
+				Name:  "app-policies",
+				Usage: "Comma separated policies the bridge may hand to applications",
+			},
+			cli.StringFlag{
+				Name:  "token-ttl",
+				Value: "72h",
+				Usage: "TTL of the bridge's issuing token, the server keeps renewing it",
+			},
+			cli.StringFlag{
+				Name:  "cubbypath",
+				Usage: "Cubbyhole path the server reads its issuing token from, defaults to cubbyhole/<environment>",
+			},
+			cli.StringFlag{
+				Name:  "example-path",
+				Value: "example",
+				Usage: "Config path entry written with the default policy when missing, empty skips it",
+			},
+			cli.BoolFlag{
+				Name:  "rotate",
+				Usage: "Revoke the issuing token of an earlier run, with every token it issued, and create a new one",
+			},
+		},
+	}
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"github.com/rancher/secrets-bridge/agent"
+	"github.com/rancher/secrets-bridge/bridge"
+	"github.com/urfave/cli"
+)
+
+func DoctorCommand() cli.Command {
+	return cli.Command{
+		Name:  "doctor",
+		Usage: "Checks the setup of a server or agent and suggests fixes",
+		Subcommands: []cli.Command{
+			{
+				Name:   "server",
+				Usage:  "Checks Vault and Rancher with the server's flags",
+				Action: bridge.DoctorServer,
+				Flags: append(serverFlags(),
+					cli.StringFlag{
+						Name:   "issuing-token",
+						Usage:  "The server's issuing token, to check it without spending the temp token",
+						EnvVar: "SECRETS_BRIDGE_ISSUING_TOKEN",
+					},
+				),
+			},
+			{
+				Name:   "agent",
+				Usage:  "Checks the host and the bridge with the agent's flags",
+				Action: agent.DoctorAgent,
+				Flags:  agentFlags(),
+			},
+		},
+	}
+}
@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/rancher/secrets-bridge/bridge"
+	"github.com/rancher/secrets-bridge/verifier"
 	"github.com/urfave/cli"
 )
 
@@ -10,41 +13,104 @@ func ServerCommand() cli.Command {
 		Name:   "server",
 		Usage:  "Provides a Secrets endpoint for verification and credential creation",
 		Action: bridge.StartServer,
-		Flags: []cli.Flag{
-			cli.StringFlag{
-				Name:  "vault-url",
-				Usage: "URL to Vault server. http://127.0.0.1:8200",
-			},
-			cli.StringFlag{
-				Name:   "vault-token",
-				Usage:  "CubbyHole Vault Token to use to communicate with Vault",
-				EnvVar: "VAULT_TOKEN",
-			},
-			cli.StringFlag{
-				Name:   "vault-cacert",
-				Usage:  "CA Pem to use to communicate with Vault",
-				EnvVar: "VAULT_CA_CERT",
+		Flags: append(serverFlags(),
+			cli.DurationFlag{
+				Name:  "lease-interval",
+				Value: time.Minute,
+				Usage: "How often tokens of config paths with renew=true are checked for renewal, 0 disables renewal",
 			},
-			cli.StringFlag{
-				Name:   "vault-cubbypath",
-				Usage:  "CubbyHole path to get Vault Token",
-				EnvVar: "VAULT_CUBBYPATH",
+			cli.DurationFlag{
+				Name:  "lease-liveness",
+				Value: 3 * time.Minute,
+				Usage: "How long after the last agent heartbeat naming one of its containers a token is still renewed",
 			},
 			cli.StringFlag{
-				Name:   "rancher-url",
-				Usage:  "Rancher API endpoint to verify",
-				EnvVar: "CATTLE_URL",
+				Name:   "agent-signing-key",
+				Usage:  "Key the agents sign requests with, heartbeats and destroy events are refused without it",
+				EnvVar: "SECRETS_BRIDGE_SIGNING_KEY",
 			},
 			cli.StringFlag{
-				Name:   "rancher-secret",
-				Usage:  "Rancher API secret key",
-				EnvVar: "CATTLE_SECRET_KEY",
+				Name:  "metrics-listen",
+				Value: "127.0.0.1:8182",
+				Usage: "Address the cache and lease counters are served on at /debug/vars, empty turns it off",
 			},
-			cli.StringFlag{
-				Name:   "rancher-access",
-				Usage:  "Rancher API access key",
-				EnvVar: "CATTLE_ACCESS_KEY",
+			cli.DurationFlag{
+				Name:  "max-clock-skew",
+				Value: 30 * time.Second,
+				Usage: "How far the timestamp of an agent's signature may be off",
 			},
+		),
+	}
+}
+
+// serverFlags are shared by the server and the commands acting for it.
+func serverFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "vault-url",
+			Usage: "URL to Vault server. http://127.0.0.1:8200",
+		},
+		cli.StringFlag{
+			Name:   "vault-token",
+			Usage:  "CubbyHole Vault Token to use to communicate with Vault",
+			EnvVar: "VAULT_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "vault-cacert",
+			Usage:  "CA Pem to use to communicate with Vault",
+			EnvVar: "VAULT_CA_CERT",
+		},
+		cli.StringFlag{
+			Name:   "vault-advertise-cacert",
+			Usage:  "CA Pem handed to containers for Vault, defaults to vault-cacert",
+			EnvVar: "VAULT_ADVERTISE_CA_CERT",
+		},
+		cli.StringFlag{
+			Name:   "vault-cubbypath",
+			Usage:  "CubbyHole path to get Vault Token",
+			EnvVar: "VAULT_CUBBYPATH",
+		},
+		cli.BoolFlag{
+			Name:   "require-token-role",
+			Usage:  "Refuse to create Vault tokens without a token role",
+			EnvVar: "VAULT_REQUIRE_TOKEN_ROLE",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "JSON file listing the Rancher environments to serve, replaces the rancher-* flags",
+			EnvVar: "SECRETS_BRIDGE_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "rancher-url",
+			Usage:  "Rancher API endpoint to verify",
+			EnvVar: "CATTLE_URL",
+		},
+		cli.StringFlag{
+			Name:   "rancher-secret",
+			Usage:  "Rancher API secret key",
+			EnvVar: "CATTLE_SECRET_KEY",
+		},
+		cli.StringFlag{
+			Name:   "rancher-access",
+			Usage:  "Rancher API access key",
+			EnvVar: "CATTLE_ACCESS_KEY",
+		},
+		cli.DurationFlag{
+			Name:  "rancher-cache-ttl",
+			Value: 5 * time.Minute,
+			Usage: "How long Rancher service, stack and environment lookups are cached",
+		},
+		cli.StringFlag{
+			Name:   "cattle-path-template",
+			Value:  verifier.DefaultCattlePathTemplate,
+			Usage:  "Template for the Vault path of Cattle containers",
+			EnvVar: "CATTLE_PATH_TEMPLATE",
+		},
+		cli.StringFlag{
+			Name:   "k8s-path-template",
+			Value:  verifier.DefaultK8sPathTemplate,
+			Usage:  "Template for the Vault path of Kubernetes containers",
+			EnvVar: "K8S_PATH_TEMPLATE",
 		},
 	}
 }
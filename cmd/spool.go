@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"github.com/rancher/secrets-bridge/agent"
+	"github.com/urfave/cli"
+)
+
+func SpoolCommand() cli.Command {
+	return cli.Command{
+		Name:   "spool",
+		Usage:  "Show credential deliveries the local agent is waiting to retry",
+		Action: agent.ShowSpool,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "state-dir",
+				Value: "/var/lib/secrets-bridge",
+				Usage: "State directory of the agent",
+			},
+		},
+	}
+}
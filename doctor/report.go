@@ -0,0 +1,50 @@
+package doctor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Report prints the outcome of each check, with a hint on how to fix the
+// ones that failed.
+type Report struct {
+	out    io.Writer
+	failed int
+}
+
+func NewReport() *Report {
+	return &Report{out: os.Stdout}
+}
+
+func (r *Report) Pass(check, detail string) {
+	fmt.Fprintf(r.out, "PASS  %s: %s\n", check, detail)
+}
+
+func (r *Report) Fail(check string, err error, hint string) {
+	r.failed++
+	// Vault's errors span several lines
+	fmt.Fprintf(r.out, "FAIL  %s: %s\n", check, strings.Join(strings.Fields(err.Error()), " "))
+	if hint != "" {
+		fmt.Fprintf(r.out, "      hint: %s\n", hint)
+	}
+}
+
+// Skip reports a check that could not run, without failing the report.
+func (r *Report) Skip(check, reason string) {
+	fmt.Fprintf(r.out, "SKIP  %s: %s\n", check, reason)
+}
+
+func (r *Report) Failed() bool {
+	return r.failed > 0
+}
+
+// Exit ends the process, with a non-zero status when a check failed.
+func (r *Report) Exit() {
+	if r.Failed() {
+		fmt.Fprintf(r.out, "\n%d check(s) failed\n", r.failed)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
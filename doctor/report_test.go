@@ -0,0 +1,82 @@
+package doctor
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks func(*Report)
+		want   string
+		failed bool
+	}{
+		{
+			name:   "nothing checked",
+			checks: func(r *Report) {},
+		},
+		{
+			name: "pass",
+			checks: func(r *Report) {
+				r.Pass("Vault", "reachable at https://vault:8200")
+			},
+			want: "PASS  Vault: reachable at https://vault:8200\n",
+		},
+		{
+			name: "skip",
+			checks: func(r *Report) {
+				r.Skip("Signature", "the bridge does not verify signatures")
+			},
+			want: "SKIP  Signature: the bridge does not verify signatures\n",
+		},
+		{
+			name: "fail with hint",
+			checks: func(r *Report) {
+				r.Fail("Bridge", errors.New("connection refused"), "check --bridge-url")
+			},
+			want:   "FAIL  Bridge: connection refused\n      hint: check --bridge-url\n",
+			failed: true,
+		},
+		{
+			name: "fail without hint",
+			checks: func(r *Report) {
+				r.Fail("Bridge", errors.New("connection refused"), "")
+			},
+			want:   "FAIL  Bridge: connection refused\n",
+			failed: true,
+		},
+		{
+			name: "multi-line error",
+			checks: func(r *Report) {
+				r.Fail("Vault", errors.New("Error making API request.\n\nCode: 403. Errors:\n\n* permission denied"), "")
+			},
+			want:   "FAIL  Vault: Error making API request. Code: 403. Errors: * permission denied\n",
+			failed: true,
+		},
+		{
+			name: "mixed",
+			checks: func(r *Report) {
+				r.Pass("Vault", "ok")
+				r.Skip("Signature", "no key")
+				r.Fail("Bridge", errors.New("timeout"), "")
+			},
+			want:   "PASS  Vault: ok\nSKIP  Signature: no key\nFAIL  Bridge: timeout\n",
+			failed: true,
+		},
+	}
+
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		r := &Report{out: out}
+		test.checks(r)
+
+		if out.String() != test.want {
+			t.Errorf("%s: printed %q, want %q", test.name, out.String(), test.want)
+		}
+		if r.Failed() != test.failed {
+			t.Errorf("%s: failed is %t, want %t", test.name, r.Failed(), test.failed)
+		}
+	}
+}
@@ -29,6 +29,9 @@ func main() {
 	app.Commands = []cli.Command{
 		cmd.ServerCommand(),
 		cmd.AgentCommand(),
+		cmd.SpoolCommand(),
+		cmd.BootstrapCommand(),
+		cmd.DoctorCommand(),
 	}
 
 	app.Run(os.Args)
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Handler writes only the named expvar variables, leaving out cmdline and its flags.
+func Handler(names ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		fmt.Fprint(w, "{\n")
+		first := true
+		for _, name := range names {
+			v := expvar.Get(name)
+			if v == nil {
+				continue
+			}
+			if !first {
+				fmt.Fprint(w, ",\n")
+			}
+			first = false
+			fmt.Fprintf(w, "%q: %s", name, v.String())
+		}
+		fmt.Fprint(w, "\n}\n")
+	})
+}
+
+// Serve publishes the named variables at /debug/vars on listen, an empty
+// listen address turns it off.
+func Serve(listen string, names ...string) {
+	if listen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", Handler(names...))
+
+	logrus.Infof("Serving metrics on: %s", listen)
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		logrus.Errorf("Metrics listener stopped: %s", err)
+	}
+}
@@ -5,9 +5,13 @@ import (
 	"bytes"
 )
 
+// ArchiveFile is a file to put in the archive. A zero Mode means 0600.
 type ArchiveFile struct {
 	Name    string
 	Content string
+	Mode    int64
+	Uid     int
+	Gid     int
 }
 
 func CreateTarArchive(files []ArchiveFile) (*bytes.Buffer, error) {
@@ -15,9 +19,16 @@ func CreateTarArchive(files []ArchiveFile) (*bytes.Buffer, error) {
 	tw := tar.NewWriter(buffer)
 
 	for _, file := range files {
+		mode := file.Mode
+		if mode == 0 {
+			mode = 0600
+		}
+
 		hdr := &tar.Header{
 			Name: file.Name,
-			Mode: 0600,
+			Mode: mode,
+			Uid:  file.Uid,
+			Gid:  file.Gid,
 			Size: int64(len(file.Content)),
 		}
 
@@ -0,0 +1,14 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// SignaturePayload is what an agent signs a request with: its UUID, the
+// timestamp, the method, the path and the SHA-256 of the body.
+func SignaturePayload(uuid, ts, method, path string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(strings.Join([]string{uuid, ts, method, path, hex.EncodeToString(sum[:])}, "\n"))
+}
@@ -7,5 +7,16 @@ type Message struct {
 	UUID          string `json:"UUID"`
 	Action        string `json:"Action"`
 	Host          string `json:"Host"`
+	Environment   string `json:"Environment"`
+	Phase         string `json:"phase"`
+	Restart       bool   `json:"restart,omitempty"`
 	ContainerType string `json:"container_type"`
 }
+
+// Heartbeat lists the containers running on an agent's host, so the bridge
+// knows which of their tokens are still in use.
+type Heartbeat struct {
+	Host        string   `json:"Host"`
+	Environment string   `json:"Environment"`
+	Containers  []string `json:"containers"`
+}
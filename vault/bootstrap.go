@@ -0,0 +1,214 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+)
+
+// BootstrapConfig describes the Vault setup a bridge server needs.
+type BootstrapConfig struct {
+	Environment string
+	ConfigPath  string
+	Policy      string
+	TokenRole   string
+	AppPolicies []string
+	TokenTTL    string
+	CubbyPath   string
+	ExamplePath string
+	Rotate      bool
+}
+
+// BootstrapResult is what the server is started with.
+type BootstrapResult struct {
+	TempToken    string
+	CubbyPath    string
+	CreatedToken bool
+}
+
+// issuingTokenPath is where the issuing token is kept in the cubbyhole of
+// the admin token, so bootstrapping again with it finds the token.
+const issuingTokenPath = "cubbyhole/secrets-bridge/"
+
+// NewAdminClient connects to Vault with an administrative token.
+func NewAdminClient(opts map[string]interface{}) (*api.Client, error) {
+	var err error
+	config := api.DefaultConfig()
+
+	if url, ok := opts["vault-url"].(string); ok && url != "" {
+		config.Address = url
+	}
+
+	config.HttpClient.Transport, err = buildTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if token, ok := opts["vault-token"].(string); ok && token != "" {
+		client.SetToken(token)
+	}
+
+	return client, nil
+}
+
+// Bootstrap sets up the bridge's policy, role, issuing token and an example entry.
+func Bootstrap(client *api.Client, config *BootstrapConfig) (*BootstrapResult, error) {
+	if config.ConfigPath == "" || config.Policy == "" || config.TokenRole == "" || config.CubbyPath == "" {
+		return nil, errors.New("Config path, policy, token role and cubbyhole path must be set")
+	}
+
+	logrus.Infof("Writing policy %s", config.Policy)
+	if err := client.Sys().PutPolicy(config.Policy, bridgePolicy(config)); err != nil {
+		return nil, err
+	}
+
+	allowed := append([]string{"default", config.Policy}, config.AppPolicies...)
+	logrus.Infof("Writing token role %s allowing policies %s", config.TokenRole, strings.Join(allowed, ","))
+	if _, err := client.Logical().Write("auth/token/roles/"+config.TokenRole, map[string]interface{}{
+		"allowed_policies": strings.Join(allowed, ","),
+	}); err != nil {
+		return nil, err
+	}
+
+	result := &BootstrapResult{
+		CubbyPath: config.CubbyPath,
+	}
+
+	issuingToken, err := existingIssuingToken(client, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if issuingToken == "" {
+		logrus.Infof("Creating issuing token with configPath %s", config.ConfigPath)
+		secret, err := client.Auth().Token().CreateWithRole(&api.TokenCreateRequest{
+			Policies:    allowed,
+			Metadata:    map[string]string{"configPath": config.ConfigPath},
+			TTL:         config.TokenTTL,
+			DisplayName: "secrets-bridge-" + config.Environment,
+		}, config.TokenRole)
+		if err != nil {
+			return nil, err
+		}
+		issuingToken = secret.Auth.ClientToken
+		result.CreatedToken = true
+
+		if _, err := client.Logical().Write(issuingTokenPath+config.Environment, map[string]interface{}{
+			"token": issuingToken,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ExamplePath != "" {
+		if err := seedExample(client, config.ConfigPath+"/"+config.ExamplePath); err != nil {
+			return nil, err
+		}
+	}
+
+	logrus.Info("Creating temp token")
+	temp, err := client.Auth().Token().Create(&api.TokenCreateRequest{
+		Policies: []string{"default"},
+		TTL:      "15m",
+		NumUses:  2,
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.TempToken = temp.Auth.ClientToken
+
+	admin := client.Token()
+	client.SetToken(result.TempToken)
+	defer client.SetToken(admin)
+
+	if _, err := client.Logical().Write(config.CubbyPath, map[string]interface{}{
+		"permKey": issuingToken,
+	}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// existingIssuingToken returns the token kept from an earlier run while it
+// is still valid for the same config path, revoking it on rotation.
+func existingIssuingToken(client *api.Client, config *BootstrapConfig) (string, error) {
+	secret, err := client.Logical().Read(issuingTokenPath + config.Environment)
+	if err != nil || secret == nil {
+		return "", err
+	}
+
+	token, _ := secret.Data["token"].(string)
+	if token == "" {
+		return "", nil
+	}
+
+	lookup, err := client.Auth().Token().Lookup(token)
+	if err != nil || lookup == nil {
+		logrus.Infof("Issuing token from an earlier run is no longer valid")
+		return "", nil
+	}
+
+	if config.Rotate {
+		logrus.Infof("Revoking issuing token from an earlier run")
+		return "", client.Auth().Token().RevokeTree(token)
+	}
+
+	meta, _ := lookup.Data["meta"].(map[string]interface{})
+	if configPath, _ := meta["configPath"].(string); configPath != config.ConfigPath {
+		logrus.Infof("Issuing token from an earlier run has another configPath, creating a new one")
+		return "", nil
+	}
+
+	logrus.Infof("Reusing issuing token from an earlier run")
+	return token, nil
+}
+
+func seedExample(client *api.Client, path string) error {
+	existing, err := client.Logical().Read(path)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		logrus.Infof("Config path entry %s already exists", path)
+		return nil
+	}
+
+	logrus.Infof("Writing example config path entry %s", path)
+	_, err = client.Logical().Write(path, map[string]interface{}{
+		"policies": "default",
+	})
+	return err
+}
+
+func bridgePolicy(config *BootstrapConfig) string {
+	return fmt.Sprintf(`# Written by secrets-bridge bootstrap
+path "sys/*" {
+  capabilities = ["deny"]
+}
+
+path "%s/*" {
+  capabilities = ["read", "list"]
+}
+
+path "auth/token/create/%s" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+
+path "auth/token/revoke-accessor" {
+  capabilities = ["update"]
+}
+
+path "auth/token/renew" {
+  capabilities = ["update"]
+}
+`, config.ConfigPath, config.TokenRole)
+}
@@ -13,18 +13,38 @@ type CubbyHoleConfig struct {
 	PermTTL      string
 	PermUseLimit int
 	PermPolicy   string
+	PermToken    string // an app token to reuse instead of creating one
 	Path         string
 }
 
 type CubbyHoleKeys struct {
-	tempKey *api.Secret
+	tempKey   *api.Secret
+	permKey   *api.Secret
+	appConfig *AppConfig
 }
 
 func NewCubbyhole(client *VaultClient, cubbyConfig *CubbyHoleConfig) (*CubbyHoleKeys, error) {
 	metadata := make(map[string]string)
 
+	appConfig, err := client.GetAppConfig(cubbyConfig.Path)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Got policies: %s", appConfig.Policies)
+
+	if len(appConfig.Policies) == 0 {
+		return nil, errors.New("No policies to attach")
+	}
+
+	// the temp token, with only the default policy, always comes from the
+	// issuing token's role and is exempt from --require-token-role
+	appRole := client.tokenCreateRole
+	if appConfig.TokenRole != "" {
+		appRole = appConfig.TokenRole
+	}
+
 	logrus.Debugf("Getting temp token for path: %s", cubbyConfig.Path)
-	tempToken, err := createVaultToken(client, &api.TokenCreateRequest{
+	tempToken, err := createToken(client, client.tokenCreateRole, &api.TokenCreateRequest{
 		ID:              "",
 		Policies:        []string{"default"},
 		Metadata:        metadata,
@@ -39,44 +59,52 @@ func NewCubbyhole(client *VaultClient, cubbyConfig *CubbyHoleConfig) (*CubbyHole
 		return nil, err
 	}
 
-	policies, err := client.GetAppPolicies(cubbyConfig.Path)
-	if err != nil {
-		return nil, err
+	keys := &CubbyHoleKeys{
+		tempKey:   tempToken,
+		appConfig: appConfig,
 	}
-	logrus.Debugf("Got policies: %s", policies)
 
-	if len(policies) == 0 {
-		return nil, errors.New("No policies to attach")
+	permKey := cubbyConfig.PermToken
+	if permKey == "" {
+		logrus.Debugf("Getting token for path: %s with role: %s", cubbyConfig.Path, appRole)
+		permToken, err := createVaultToken(client, appRole, &api.TokenCreateRequest{
+			ID:              "",
+			Policies:        appConfig.Policies,
+			Metadata:        metadata,
+			TTL:             cubbyConfig.PermTTL,
+			NoParent:        false,
+			NoDefaultPolicy: false,
+			DisplayName:     "",
+			NumUses:         cubbyConfig.PermUseLimit,
+		})
+		if err != nil {
+			logrus.Error(err)
+			return nil, err
+		}
+		keys.permKey = permToken
+		permKey = permToken.Auth.ClientToken
 	}
 
-	permToken, err := createVaultToken(client, &api.TokenCreateRequest{
-		ID:              "",
-		Policies:        policies,
-		Metadata:        metadata,
-		TTL:             cubbyConfig.PermTTL,
-		NoParent:        false,
-		NoDefaultPolicy: false,
-		DisplayName:     "",
-		NumUses:         cubbyConfig.PermUseLimit,
-	})
-	if err != nil {
-		logrus.Error(err)
+	if err := writePermanentKey(permKey, tempToken, "cubbyhole/"+cubbyConfig.Path, client); err != nil {
 		return nil, err
 	}
 
-	if err := writePermanentKey(permToken, tempToken, "cubbyhole/"+cubbyConfig.Path, client); err != nil {
-		return nil, err
+	return keys, nil
+}
+
+func createVaultToken(client *VaultClient, role string, tcr *api.TokenCreateRequest) (*api.Secret, error) {
+	if role == "" && client.requireTokenRole {
+		return nil, errors.New("Refusing to create a token without a token role")
 	}
 
-	return &CubbyHoleKeys{
-		tempKey: tempToken,
-	}, nil
+	return createToken(client, role, tcr)
 }
 
-func createVaultToken(client *VaultClient, tcr *api.TokenCreateRequest) (*api.Secret, error) {
-	if client.tokenCreateRole != "" {
-		return client.VClient.Auth().Token().CreateWithRole(tcr, client.tokenCreateRole)
+func createToken(client *VaultClient, role string, tcr *api.TokenCreateRequest) (*api.Secret, error) {
+	if role != "" {
+		return client.VClient.Auth().Token().CreateWithRole(tcr, role)
 	}
+
 	logrus.Warn("You are probably running with Root keys...and thats probably not good")
 	return client.VClient.Auth().Token().Create(tcr)
 }
@@ -85,11 +113,27 @@ func (chk *CubbyHoleKeys) TempToken() *api.Secret {
 	return chk.tempKey
 }
 
-func writePermanentKey(perm, temp *api.Secret, path string, client *VaultClient) error {
-	client.VClient.SetToken(temp.Auth.ClientToken)
-	defer client.VClient.SetToken(client.token)
+// PermToken is the app token created for the cubbyhole, nil when an
+// existing one was reused.
+func (chk *CubbyHoleKeys) PermToken() *api.Secret {
+	return chk.permKey
+}
+
+// AppConfig is the config path entry the keys were issued under.
+func (chk *CubbyHoleKeys) AppConfig() *AppConfig {
+	return chk.appConfig
+}
+
+// writePermanentKey writes into the temp token's cubbyhole with a client of
+// its own, the shared client keeps the issuing token for concurrent calls.
+func writePermanentKey(perm string, temp *api.Secret, path string, client *VaultClient) error {
+	tempClient, err := api.NewClient(client.config)
+	if err != nil {
+		return err
+	}
+	tempClient.SetToken(temp.Auth.ClientToken)
 
-	_, err := client.VClient.Logical().Write(path, map[string]interface{}{"permKey": perm.Auth.ClientToken})
+	_, err = tempClient.Logical().Write(path, map[string]interface{}{"permKey": perm})
 	if err != nil {
 		return err
 	}
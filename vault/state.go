@@ -0,0 +1,61 @@
+package vault
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+// statePath is in the issuing token's cubbyhole, only the bridge can read it.
+const statePath = "cubbyhole/secrets-bridge/state/"
+
+// StateStore keeps small named blobs for the bridge.
+type StateStore interface {
+	LoadState(name string) ([]byte, error)
+	SaveState(name string, data []byte) error
+	DeleteState(name string) error
+	ListState() ([]string, error)
+}
+
+// LoadState returns nil when nothing is stored under name.
+func (vClient *VaultClient) LoadState(name string) ([]byte, error) {
+	secret, err := vClient.VClient.Logical().Read(statePath + name)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+
+	encoded, ok := secret.Data["data"].(string)
+	if !ok {
+		return nil, errors.New("Malformed state at " + statePath + name)
+	}
+
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+func (vClient *VaultClient) SaveState(name string, data []byte) error {
+	_, err := vClient.VClient.Logical().Write(statePath+name, map[string]interface{}{
+		"data": base64.StdEncoding.EncodeToString(data),
+	})
+	return err
+}
+
+func (vClient *VaultClient) DeleteState(name string) error {
+	_, err := vClient.VClient.Logical().Delete(statePath + name)
+	return err
+}
+
+func (vClient *VaultClient) ListState() ([]string, error) {
+	secret, err := vClient.VClient.Logical().List(statePath)
+	if err != nil || secret == nil || secret.Data == nil {
+		return nil, err
+	}
+
+	keys, _ := secret.Data["keys"].([]interface{})
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if name, ok := key.(string); ok {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
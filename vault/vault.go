@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,16 +18,54 @@ import (
 )
 
 type SecureStore interface {
-	CreateSecretKey(verifier.VerifiedResponse) (string, error)
+	CreateSecretKey(verifier.VerifiedResponse) (*SecretKey, error)
+	ReissueSecretKey(verified verifier.VerifiedResponse, permToken string) (*SecretKey, error)
+	RevokeAccessor(accessor string) error
+	RenewToken(token string, increment int) (int, error)
 	GetSecretStoreURL() string
+	GetAddress() string
+	GetCABundle() string
+	ForEnvironment(configPath, tokenRole string) SecureStore
 }
 
 type VaultClient struct {
-	VClient         *api.Client
-	config          *api.Config
-	envConfigPath   string // This is where to look for policy information.
-	token           string
-	tokenCreateRole string // The tokens can only create on this path...
+	VClient          *api.Client
+	config           *api.Config
+	envConfigPath    string // This is where to look for policy information.
+	token            string
+	tokenCreateRole  string // The tokens can only create on this path...
+	requireTokenRole bool
+	caBundle         string // CA PEM handed to containers with their token
+}
+
+const (
+	// RestartPolicyRevoke revokes a restarted container's old token and
+	// issues it a new one.
+	RestartPolicyRevoke = "revoke"
+	// RestartPolicyReuse hands a restarted container its old token again.
+	RestartPolicyReuse = "reuse"
+)
+
+// SecretKey is the temp token a container uses to open its cubbyhole,
+// along with the app token waiting in it.
+type SecretKey struct {
+	Token         string
+	TTL           int
+	PermToken     string
+	PermAccessor  string
+	PermTTL       int
+	RestartPolicy string
+	Renew         bool
+	MaxTTL        int
+}
+
+// AppConfig is what the bridge reads from a config path entry.
+type AppConfig struct {
+	Policies      []string
+	TokenRole     string
+	RestartPolicy string
+	Renew         bool
+	MaxTTL        int // seconds, 0 leaves it to Vault
 }
 
 func NewSecureStore(opts map[string]interface{}) (SecureStore, error) {
@@ -69,12 +108,24 @@ func NewVaultSecureStore(opts map[string]interface{}) (*VaultClient, error) {
 
 	role := inspectSelfTokenForRole(tokenSecret)
 
+	requireRole, _ := opts["require-token-role"].(bool)
+	if requireRole {
+		logrus.Info("Tokens will only be created through a token role")
+	}
+
+	caBundle, err := readCABundle(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	vaultClient := &VaultClient{
-		VClient:         client,
-		config:          config,
-		envConfigPath:   configPath,
-		token:           permKey,
-		tokenCreateRole: role,
+		caBundle:         caBundle,
+		VClient:          client,
+		config:           config,
+		envConfigPath:    configPath,
+		token:            permKey,
+		tokenCreateRole:  role,
+		requireTokenRole: requireRole,
 	}
 
 	// handle refreshing the issuing token
@@ -111,6 +162,26 @@ func buildTransport(opts map[string]interface{}) (*http.Transport, error) {
 	return transport, nil
 }
 
+// readCABundle loads the CA handed to containers, which defaults to the one
+// the bridge itself trusts for Vault.
+func readCABundle(opts map[string]interface{}) (string, error) {
+	caFile, _ := opts["vault-advertise-cacert"].(string)
+	if caFile == "" {
+		caFile, _ = opts["vault-cacert"].(string)
+	}
+
+	if caFile == "" {
+		return "", nil
+	}
+
+	content, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
+
 func (vc *VaultClient) manageIssuingTokenRefresh() {
 	go func() {
 		secret, err := selfTokenSecret(vc.VClient)
@@ -205,33 +276,109 @@ func scheduleTimer(duration int, notify chan bool) {
 }
 
 // We create cubbyholes in order to pass credentials
-func (vClient *VaultClient) CreateSecretKey(verified verifier.VerifiedResponse) (string, error) {
+func (vClient *VaultClient) CreateSecretKey(verified verifier.VerifiedResponse) (*SecretKey, error) {
+	return vClient.createSecretKey(verified, "")
+}
+
+// ReissueSecretKey puts an app token issued earlier into a new cubbyhole,
+// for a restarted container that keeps its token.
+func (vClient *VaultClient) ReissueSecretKey(verified verifier.VerifiedResponse, permToken string) (*SecretKey, error) {
+	if permToken == "" {
+		return nil, errors.New("No token to reissue")
+	}
+	return vClient.createSecretKey(verified, permToken)
+}
+
+func (vClient *VaultClient) createSecretKey(verified verifier.VerifiedResponse, permToken string) (*SecretKey, error) {
 	if !verified.Verified() {
-		return "", errors.New("Secret creation aborted for unverified object")
+		return nil, errors.New("Secret creation aborted for unverified object")
 	}
 	cubbyConfig := &CubbyHoleConfig{
 		TempTTL:      "300s",
 		TempUseLimit: 2,
 		PermTTL:      "1h",
 		PermUseLimit: 0,
+		PermToken:    permToken,
 		Path:         verified.Path(),
 	}
 
 	cubbyHoleKeys, err := NewCubbyhole(vClient, cubbyConfig)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	key := &SecretKey{
+		Token:         cubbyHoleKeys.TempToken().Auth.ClientToken,
+		TTL:           cubbyHoleKeys.TempToken().Auth.LeaseDuration,
+		PermToken:     permToken,
+		RestartPolicy: cubbyHoleKeys.AppConfig().RestartPolicy,
+		Renew:         cubbyHoleKeys.AppConfig().Renew,
+		MaxTTL:        cubbyHoleKeys.AppConfig().MaxTTL,
+	}
+
+	if perm := cubbyHoleKeys.PermToken(); perm != nil {
+		key.PermToken = perm.Auth.ClientToken
+		key.PermAccessor = perm.Auth.Accessor
+		key.PermTTL = perm.Auth.LeaseDuration
+	}
+
+	return key, nil
+}
+
+// RevokeAccessor revokes an app token without needing the token itself.
+func (vClient *VaultClient) RevokeAccessor(accessor string) error {
+	return vClient.VClient.Auth().Token().RevokeAccessor(accessor)
+}
+
+// RenewToken extends an app token by increment seconds, returning the TTL
+// Vault actually gave it, which stops growing at the token's max TTL.
+func (vClient *VaultClient) RenewToken(token string, increment int) (int, error) {
+	secret, err := vClient.VClient.Auth().Token().Renew(token, increment)
+	if err != nil {
+		return 0, err
+	}
+
+	if secret == nil || secret.Auth == nil {
+		return 0, errors.New("Vault returned no lease for the renewed token")
+	}
+
+	return secret.Auth.LeaseDuration, nil
+}
+
+// ForEnvironment returns a store sharing this client's connection and
+// issuing token, with the config path and token role overridden when set.
+func (vClient *VaultClient) ForEnvironment(configPath, tokenRole string) SecureStore {
+	scoped := *vClient
+
+	if configPath != "" {
+		scoped.envConfigPath = configPath
+	}
+
+	if tokenRole != "" {
+		scoped.tokenCreateRole = tokenRole
 	}
 
-	return cubbyHoleKeys.TempToken().Auth.ClientToken, nil
+	return &scoped
 }
 
 func (vClient *VaultClient) GetSecretStoreURL() string {
 	return vClient.config.Address + "/v1"
 }
 
-func (vClient *VaultClient) GetAppPolicies(appPath string) ([]string, error) {
+func (vClient *VaultClient) GetAddress() string {
+	return vClient.config.Address
+}
+
+func (vClient *VaultClient) GetCABundle() string {
+	return vClient.caBundle
+}
+
+// GetAppConfig returns the most specific config path entry with policies.
+func (vClient *VaultClient) GetAppConfig(appPath string) (*AppConfig, error) {
 	// OK, lets get the most specific...
-	policies := []string{}
+	appConfig := &AppConfig{
+		Policies: []string{},
+	}
 
 	splitPath := strings.Split(appPath, "/")
 	for i := strings.Count(appPath, "/") + 1; i >= 0; i-- {
@@ -240,17 +387,102 @@ func (vClient *VaultClient) GetAppPolicies(appPath string) ([]string, error) {
 		logrus.Debugf("Trying path: %s", fullPath)
 		secret, err := vClient.VClient.Logical().Read(fullPath)
 		if err != nil && i != 0 {
-			return policies, err
+			return appConfig, err
 		}
 
 		if secret != nil {
 			if policies, ok := secret.Data["policies"]; ok {
-				return strings.Split(policies.(string), ","), nil
+				appConfig.Policies = strings.Split(policies.(string), ",")
+				if role, ok := secret.Data["token_role"].(string); ok {
+					appConfig.TokenRole = role
+				}
+				appConfig.RestartPolicy = parseRestartPolicy(secret.Data["restart_policy"])
+				appConfig.Renew, appConfig.MaxTTL = parseRenewal(secret.Data["renew"], secret.Data["max_ttl"])
+				return appConfig, nil
 			}
 		}
 	}
 
-	return policies, nil
+	return appConfig, nil
+}
+
+func parseRestartPolicy(value interface{}) string {
+	policy, _ := value.(string)
+	switch policy {
+	case "", RestartPolicyRevoke:
+		return RestartPolicyRevoke
+	case RestartPolicyReuse:
+		return RestartPolicyReuse
+	default:
+		logrus.Warnf("Unknown restart_policy %s, revoking on restart", policy)
+		return RestartPolicyRevoke
+	}
+}
+
+func parseRenewal(renew, maxTTL interface{}) (bool, int) {
+	enabled, _ := renew.(string)
+	if enabled != "true" {
+		return false, 0
+	}
+
+	value, _ := maxTTL.(string)
+	if value == "" {
+		return true, 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return true, seconds
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		logrus.Warnf("Unknown max_ttl %s, renewing up to the token's own max TTL", value)
+		return true, 0
+	}
+	return true, int(duration.Seconds())
+}
+
+// TokenInfo is what the bridge relies on about its issuing token.
+type TokenInfo struct {
+	TTL        int
+	Renewable  bool
+	Role       string
+	ConfigPath string
+}
+
+// InspectToken looks up the client's own token.
+func InspectToken(c *api.Client) (*TokenInfo, error) {
+	secret, err := selfTokenSecret(c)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, errors.New("Vault returned no data for the token")
+	}
+
+	info := &TokenInfo{
+		Role: inspectSelfTokenForRole(secret),
+	}
+	info.TTL, _ = getIntFromJsonInterface(secret.Data["ttl"])
+	info.Renewable, _ = secret.Data["renewable"].(bool)
+
+	meta, _ := secret.Data["meta"].(map[string]interface{})
+	info.ConfigPath, _ = meta["configPath"].(string)
+
+	return info, nil
+}
+
+// CheckCACert makes sure a CA file holds at least one PEM certificate.
+func CheckCACert(caFile string) error {
+	content, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+
+	if !x509.NewCertPool().AppendCertsFromPEM(content) {
+		return errors.New("No PEM certificate found in " + caFile)
+	}
+	return nil
 }
 
 func selfTokenSecret(c *api.Client) (*api.Secret, error) {
@@ -0,0 +1,237 @@
+package verifier
+
+import (
+	"encoding/base64"
+	"expvar"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher/client"
+)
+
+const (
+	serviceKind = "service"
+	stackKind   = "stack"
+	projectKind = "project"
+
+	defaultCacheTTL = 5 * time.Minute
+)
+
+var cacheMetrics = expvar.NewMap("topologyCache")
+
+// TopologyCache caches Rancher link lookups until a change event or the TTL.
+type TopologyCache struct {
+	client          *client.RancherClient
+	environmentName string
+	ttl             time.Duration
+	mu              sync.RWMutex
+	entries         map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	sourceID string
+	objectID string
+	value    interface{}
+	expires  time.Time
+}
+
+func NewTopologyCache(c *client.RancherClient, environmentName string, ttl time.Duration) *TopologyCache {
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+
+	return &TopologyCache{
+		client:          c,
+		environmentName: environmentName,
+		ttl:             ttl,
+		entries:         map[string]*cacheEntry{},
+	}
+}
+
+func (tc *TopologyCache) ServiceForContainer(container *client.Container) (*client.Service, error) {
+	value, err := tc.lookup(serviceKind, container.Id, func() (string, interface{}, error) {
+		svc, err := getServiceFromContainer(tc.client, container)
+		if err != nil {
+			return "", nil, err
+		}
+		return svc.Id, svc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*client.Service), nil
+}
+
+func (tc *TopologyCache) StackForService(svc *client.Service) (*client.Environment, error) {
+	value, err := tc.lookup(stackKind, svc.Id, func() (string, interface{}, error) {
+		stk, err := getStackFromService(tc.client, svc)
+		if err != nil {
+			return "", nil, err
+		}
+		return stk.Id, stk, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*client.Environment), nil
+}
+
+func (tc *TopologyCache) ProjectForStack(stk *client.Environment) (*client.Project, error) {
+	value, err := tc.lookup(projectKind, stk.Id, func() (string, interface{}, error) {
+		env, err := getEnvFromStack(tc.client, stk)
+		if err != nil {
+			return "", nil, err
+		}
+		return env.Id, env, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*client.Project), nil
+}
+
+// ProjectForAPIKey caches the project the API key resolves to.
+func (tc *TopologyCache) ProjectForAPIKey() (*client.Project, error) {
+	value, err := tc.lookup(projectKind, "apikey", func() (string, interface{}, error) {
+		project, err := getProjectFromAPIKey(tc.client, tc.environmentName)
+		if err != nil {
+			return "", nil, err
+		}
+		return project.Id, project, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*client.Project), nil
+}
+
+func (tc *TopologyCache) lookup(kind, sourceID string, fetch func() (string, interface{}, error)) (interface{}, error) {
+	key := kind + ":" + sourceID
+
+	tc.mu.RLock()
+	entry, ok := tc.entries[key]
+	tc.mu.RUnlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		cacheMetrics.Add(kind+".hits", 1)
+		return entry.value, nil
+	}
+	cacheMetrics.Add(kind+".misses", 1)
+
+	if ok {
+		tc.mu.Lock()
+		if tc.entries[key] == entry {
+			delete(tc.entries, key)
+		}
+		tc.mu.Unlock()
+	}
+
+	objectID, value, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	tc.mu.Lock()
+	tc.entries[key] = &cacheEntry{
+		sourceID: sourceID,
+		objectID: objectID,
+		value:    value,
+		expires:  time.Now().Add(tc.ttl),
+	}
+	tc.mu.Unlock()
+
+	return value, nil
+}
+
+// Invalidate drops every entry that was looked up from, or resolved to,
+// the resource with the given ID, and sweeps expired entries along the way.
+func (tc *TopologyCache) Invalidate(resourceID string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range tc.entries {
+		if entry.sourceID == resourceID || entry.objectID == resourceID {
+			delete(tc.entries, key)
+			cacheMetrics.Add("invalidations", 1)
+		} else if !now.Before(entry.expires) {
+			delete(tc.entries, key)
+		}
+	}
+}
+
+func (tc *TopologyCache) Flush() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.entries = map[string]*cacheEntry{}
+	cacheMetrics.Add("flushes", 1)
+}
+
+// Subscribe listens on the Rancher event websocket for resource changes
+// and invalidates matching entries. It reconnects until the process exits.
+func (tc *TopologyCache) Subscribe() {
+	go func() {
+		backoff := 1 * time.Second
+		maxBackoff := 60 * time.Second
+
+		for {
+			err := tc.listen()
+			logrus.Warnf("Rancher event subscription dropped: %s", err)
+
+			// Events may have been missed while disconnected.
+			tc.Flush()
+
+			time.Sleep(backoff)
+			if backoff < maxBackoff {
+				backoff *= 2
+			}
+		}
+	}()
+}
+
+func (tc *TopologyCache) listen() error {
+	url := subscribeURL(tc.client.Opts.Url)
+
+	auth := base64.StdEncoding.EncodeToString([]byte(tc.client.Opts.AccessKey + ":" + tc.client.Opts.SecretKey))
+	headers := http.Header{}
+	headers.Add("Authorization", "Basic "+auth)
+
+	conn, _, err := tc.client.Websocket(url, headers)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	logrus.Infof("Subscribed to Rancher events: %s", url)
+
+	for {
+		event := &client.Publish{}
+		if err := conn.ReadJSON(event); err != nil {
+			return err
+		}
+
+		if event.ResourceId == "" {
+			continue
+		}
+
+		switch event.ResourceType {
+		case "container", "service", "environment", "stack", "project", "account":
+			logrus.Debugf("Invalidating %s %s", event.ResourceType, event.ResourceId)
+			tc.Invalidate(event.ResourceId)
+		}
+	}
+}
+
+func subscribeURL(apiURL string) string {
+	url := strings.TrimSuffix(apiURL, "/")
+	if strings.HasPrefix(url, "https://") {
+		url = "wss://" + strings.TrimPrefix(url, "https://")
+	} else {
+		url = "ws://" + strings.TrimPrefix(url, "http://")
+	}
+	return url + "/subscribe?eventNames=resource.change"
+}
@@ -0,0 +1,31 @@
+package verifier
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTopologyCacheDropsExpiredEntries(t *testing.T) {
+	tc := NewTopologyCache(nil, "", time.Minute)
+	tc.entries["service:c1"] = &cacheEntry{sourceID: "c1", objectID: "s1", value: "old", expires: time.Now().Add(-time.Second)}
+	tc.entries["service:c2"] = &cacheEntry{sourceID: "c2", objectID: "s2", value: "old", expires: time.Now().Add(-time.Second)}
+	tc.entries["service:c3"] = &cacheEntry{sourceID: "c3", objectID: "s3", value: "fresh", expires: time.Now().Add(time.Minute)}
+
+	if _, err := tc.lookup(serviceKind, "c1", func() (string, interface{}, error) {
+		return "", nil, errors.New("Rancher is down")
+	}); err == nil {
+		t.Fatal("expected the failed fetch to be returned")
+	}
+	if _, ok := tc.entries["service:c1"]; ok {
+		t.Error("the expired entry was kept after its lookup")
+	}
+
+	tc.Invalidate("s9")
+	if _, ok := tc.entries["service:c2"]; ok {
+		t.Error("the expired entry was kept after an invalidation")
+	}
+	if _, ok := tc.entries["service:c3"]; !ok {
+		t.Error("the fresh entry was dropped")
+	}
+}
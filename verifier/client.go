@@ -1,8 +1,13 @@
 package verifier
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -11,21 +16,64 @@ import (
 )
 
 type VerifierConfig struct {
-	RancherUrl       string
+	RancherUrl      string
+	EnvironmentName string
+	CacheTTL        time.Duration
+	PathTemplates   *PathTemplates
+	// AgentSigningKey is the key agents sign requests with, requests are
+	// only checked for their timestamp without it.
+	AgentSigningKey  string
+	MaxClockSkew     time.Duration
 	rancherAccessKey string
 	rancherSecretKey string
 }
 
 type Verifier interface {
 	Verify(*types.Message) (VerifiedResponse, error)
+	// AgentHost is the Rancher host the agent container with uuid runs on.
+	AgentHost(uuid string) (string, error)
+	// ContainerGone waits up to maxWait for Rancher to report the container
+	// removed.
+	ContainerGone(externalID string, maxWait time.Duration) (bool, error)
+}
+
+// AgentAuth is the agent a request came from. Signed is only set when the
+// signature was checked against the agent signing key.
+type AgentAuth struct {
+	UUID   string
+	Signed bool
 }
 
 type AuthVerifier interface {
-	VerifyAuth(string) (bool, error)
+	VerifyAuth(authString, method, path string, body []byte) (*AgentAuth, error)
+}
+
+const defaultMaxClockSkew = 30 * time.Second
+
+var removedStates = map[string]bool{
+	"removing": true,
+	"removed":  true,
+	"purging":  true,
+	"purged":   true,
 }
 
 type RancherVerifier struct {
-	client *client.RancherClient
+	client        *client.RancherClient
+	cache         *TopologyCache
+	pathTemplates *PathTemplates
+	signingKey    string
+	maxClockSkew  time.Duration
+	hostTTL       time.Duration
+
+	mu         sync.Mutex
+	agentHosts map[string]agentHost
+	// signatures seen within the clock skew, a request is only accepted once
+	signatures map[string]time.Time
+}
+
+type agentHost struct {
+	hostID  string
+	expires time.Time
 }
 
 func NewConfig(url, access, secret string) *VerifierConfig {
@@ -33,11 +81,20 @@ func NewConfig(url, access, secret string) *VerifierConfig {
 		RancherUrl:       url,
 		rancherAccessKey: access,
 		rancherSecretKey: secret,
+		PathTemplates:    NewDefaultPathTemplates(),
 	}
 }
 
 func NewVerifier(name string, config *VerifierConfig) (Verifier, error) {
-	return NewRancherVerifier(config)
+	v, err := NewRancherVerifier(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the verifying client resolves topology, so only it needs events
+	v.cache.Subscribe()
+
+	return v, nil
 }
 
 func NewAuthVerifier(name string, config *VerifierConfig) (AuthVerifier, error) {
@@ -55,26 +112,53 @@ func NewRancherVerifier(config *VerifierConfig) (*RancherVerifier, error) {
 		return nil, err
 	}
 
+	maxClockSkew := config.MaxClockSkew
+	if maxClockSkew <= 0 {
+		maxClockSkew = defaultMaxClockSkew
+	}
+
+	hostTTL := config.CacheTTL
+	if hostTTL <= 0 {
+		hostTTL = defaultCacheTTL
+	}
+
 	return &RancherVerifier{
-		client: client,
+		client:        client,
+		cache:         NewTopologyCache(client, config.EnvironmentName, config.CacheTTL),
+		pathTemplates: config.PathTemplates,
+		signingKey:    config.AgentSigningKey,
+		maxClockSkew:  maxClockSkew,
+		hostTTL:       hostTTL,
+		agentHosts:    map[string]agentHost{},
+		signatures:    map[string]time.Time{},
 	}, nil
 }
 
 func (c *RancherVerifier) Verify(msg *types.Message) (VerifiedResponse, error) {
-	resp, _ := NewVerifiedResponse(msg)
+	resp, err := NewVerifiedResponse(msg, c.pathTemplates)
+	if err != nil {
+		return nil, err
+	}
 
 	logrus.Infof("Verifing: %s", msg.UUID)
 	logrus.Debugf("Verifing: %s", msg.Action)
 	logrus.Debugf("Verifing: %s", msg.Host)
 	logrus.Debugf("Verifing: %s", msg.ContainerType)
 
-	container, err := c.requestCompleteContainerFromRancher(msg.UUID)
+	// A created container is either known to Rancher already or it has to
+	// be verified when it starts, so don't wait around for it.
+	maxWait := 60 * time.Second
+	if eventPhase(msg) == "create" {
+		maxWait = 0
+	}
+
+	container, err := c.requestCompleteContainerFromRancher(msg.UUID, maxWait)
 	if err != nil {
 		return resp, err
 	}
 
 	if c.matchInfo(msg, container) {
-		err = resp.PrepareResponse(true, &container, c.client)
+		err = resp.PrepareResponse(true, &container, c.cache)
 		if err != nil {
 			return resp, err
 		}
@@ -84,24 +168,133 @@ func (c *RancherVerifier) Verify(msg *types.Message) (VerifiedResponse, error) {
 	return resp, errors.New("Container not verified")
 }
 
-func (c *RancherVerifier) VerifyAuth(authString string) (bool, error) {
-	verified := false
+// VerifyAuth checks an agent's signature header and refuses replayed signatures.
+func (c *RancherVerifier) VerifyAuth(authString, method, path string, body []byte) (*AgentAuth, error) {
+	now := time.Now()
+
+	auth, err := verifyAuth(authString, method, path, body, c.signingKey, c.maxClockSkew, now)
+	if err != nil || !auth.Signed {
+		return auth, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for signature, expires := range c.signatures {
+		if now.After(expires) {
+			delete(c.signatures, signature)
+		}
+	}
+
+	if _, ok := c.signatures[authString]; ok {
+		return nil, errors.New("Signature was already used")
+	}
+	c.signatures[authString] = now.Add(2 * c.maxClockSkew)
+
+	return auth, nil
+}
+
+func verifyAuth(authString, method, path string, body []byte, signingKey string, maxClockSkew time.Duration, now time.Time) (*AgentAuth, error) {
 	if len(authString) <= 0 {
-		return verified, errors.New("No token found")
+		return nil, errors.New("No token found")
 	}
 	split := strings.SplitN(authString, ":", 3)
 
-	if len(split) != 3 {
-		return verified, errors.New("Malformed token")
+	if len(split) != 3 || split[0] == "" {
+		return nil, errors.New("Malformed token")
 	}
 
-	verified = true
-
 	logrus.Debugf("UUID: %s", split[0])
 	logrus.Debugf("Timestamp: %s", split[1])
 	logrus.Debugf("HMAC: %x", split[2])
 
-	return verified, nil
+	ts, err := strconv.ParseInt(split[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("Malformed token timestamp")
+	}
+
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxClockSkew {
+		return nil, fmt.Errorf("Token timestamp is %s off, more than %s", skew, maxClockSkew)
+	}
+
+	auth := &AgentAuth{UUID: split[0]}
+	if signingKey == "" {
+		return auth, nil
+	}
+
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write(types.SignaturePayload(split[0], split[1], method, path, body))
+	if !hmac.Equal(mac.Sum(nil), []byte(split[2])) {
+		return nil, errors.New("Signature does not match")
+	}
+
+	auth.Signed = true
+	return auth, nil
+}
+
+func (c *RancherVerifier) AgentHost(uuid string) (string, error) {
+	c.mu.Lock()
+	cached, ok := c.agentHosts[uuid]
+	c.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.hostID, nil
+	}
+
+	containers, err := c.client.Container.List(&client.ListOpts{
+		Filters: map[string]interface{}{
+			"uuid": uuid,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(containers.Data) == 0 || containers.Data[0].HostId == "" {
+		return "", fmt.Errorf("Agent container %s not found", uuid)
+	}
+
+	hostID := containers.Data[0].HostId
+
+	c.mu.Lock()
+	c.agentHosts[uuid] = agentHost{hostID: hostID, expires: time.Now().Add(c.hostTTL)}
+	c.mu.Unlock()
+
+	return hostID, nil
+}
+
+func (c *RancherVerifier) ContainerGone(externalID string, maxWait time.Duration) (bool, error) {
+	opts := &client.ListOpts{
+		Filters: map[string]interface{}{
+			"externalId": externalID,
+		},
+	}
+
+	for i := 1 * time.Second; ; i *= 2 {
+		containers, err := c.client.Container.List(opts)
+		if err != nil {
+			return false, err
+		}
+
+		gone := true
+		for _, container := range containers.Data {
+			if !removedStates[container.State] {
+				gone = false
+			}
+		}
+
+		if gone {
+			return true, nil
+		}
+
+		if i > maxWait {
+			return false, nil
+		}
+		time.Sleep(i)
+	}
 }
 
 func (c *RancherVerifier) matchInfo(msg *types.Message, container client.Container) bool {
@@ -124,7 +317,7 @@ func (c *RancherVerifier) matchInfoK8s(msg *types.Message, container client.Cont
 		isVerified = true
 	}
 
-	logrus.Debugf("Match K8s says Verified: %s", isVerified)
+	logrus.Debugf("Match K8s says Verified: %v", isVerified)
 
 	return isVerified
 }
@@ -143,20 +336,19 @@ func matchInfoCattle(msg *types.Message, container client.Container) bool {
 	return isVerified
 }
 
-func (c *RancherVerifier) requestCompleteContainerFromRancher(uuid string) (client.Container, error) {
+func (c *RancherVerifier) requestCompleteContainerFromRancher(uuid string, maxWait time.Duration) (client.Container, error) {
 	listOpts := &client.ListOpts{
 		Filters: map[string]interface{}{
 			"uuid": uuid,
 		},
 	}
-	return c.requestContainer(listOpts)
+	return c.requestContainer(listOpts, maxWait)
 }
 
-func (c *RancherVerifier) requestContainer(opts *client.ListOpts) (client.Container, error) {
-	maxWaitTime := 60 * time.Second
+func (c *RancherVerifier) requestContainer(opts *client.ListOpts, maxWait time.Duration) (client.Container, error) {
 	var container client.Container
 
-	for i := 1 * time.Second; i < maxWaitTime; i *= 2 * time.Second {
+	for i := 1 * time.Second; ; i *= 2 {
 		containers, err := c.client.Container.List(opts)
 		if err != nil {
 			return client.Container{}, err
@@ -171,12 +363,24 @@ func (c *RancherVerifier) requestContainer(opts *client.ListOpts) (client.Contai
 			}
 		}
 
+		if i > maxWait {
+			break
+		}
 		time.Sleep(i)
 	}
 
 	return container, nil
 }
 
+// eventPhase is the lifecycle event the request was made on. Agents that
+// predate phases only sent start events.
+func eventPhase(msg *types.Message) string {
+	if msg.Phase != "" {
+		return msg.Phase
+	}
+	return msg.Action
+}
+
 func labelExists(label string, labels map[string]interface{}) bool {
 	logrus.Debugf("looking for %s in %#v", label, labels)
 	if _, ok := labels[label]; ok {
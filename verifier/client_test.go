@@ -0,0 +1,71 @@
+package verifier
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rancher/secrets-bridge/types"
+)
+
+func sign(key string, ts int64, method, path, body string) string {
+	timestamp := strconv.FormatInt(ts, 10)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(types.SignaturePayload("uuid", timestamp, method, path, []byte(body)))
+	return "uuid:" + timestamp + ":" + string(mac.Sum(nil))
+}
+
+func TestVerifyAuth(t *testing.T) {
+	now := time.Now()
+	ts := now.Unix()
+
+	tests := []struct {
+		name   string
+		token  string
+		key    string
+		signed bool
+		err    bool
+	}{
+		{"signed", sign("key", ts, "POST", "/v1/destroy", "{}"), "key", true, false},
+		{"other body", sign("key", ts, "POST", "/v1/destroy", `{"id":1}`), "key", false, true},
+		{"other path", sign("key", ts, "POST", "/v1/heartbeat", "{}"), "key", false, true},
+		{"other method", sign("key", ts, "GET", "/v1/destroy", "{}"), "key", false, true},
+		{"wrong key", sign("other", ts, "POST", "/v1/destroy", "{}"), "key", false, true},
+		{"too old", sign("key", ts-31, "POST", "/v1/destroy", "{}"), "key", false, true},
+		{"unsigned", sign("other", ts, "POST", "/v1/destroy", "{}"), "", false, false},
+		{"unsigned too old", sign("other", ts-3600, "POST", "/v1/destroy", "{}"), "", false, true},
+		{"malformed", "uuid:yesterday:mac", "", false, true},
+		{"empty", "", "", false, true},
+	}
+
+	for _, test := range tests {
+		auth, err := verifyAuth(test.token, "POST", "/v1/destroy", []byte("{}"), test.key, 30*time.Second, now)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if auth.UUID != "uuid" || auth.Signed != test.signed {
+			t.Errorf("%s: got %#v", test.name, auth)
+		}
+	}
+}
+
+func TestVerifyAuthRefusesReplays(t *testing.T) {
+	v := &RancherVerifier{signingKey: "key", maxClockSkew: 30 * time.Second, signatures: map[string]time.Time{}}
+	token := sign("key", time.Now().Unix(), "POST", "/v1/destroy", "{}")
+
+	if _, err := v.VerifyAuth(token, "POST", "/v1/destroy", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.VerifyAuth(token, "POST", "/v1/destroy", []byte("{}")); err == nil {
+		t.Error("expected the replayed request to be refused")
+	}
+}
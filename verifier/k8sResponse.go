@@ -2,14 +2,14 @@ package verifier
 
 import (
 	"errors"
-	"fmt"
 
 	"github.com/rancher/go-rancher/client"
 )
 
-func (rvr *RancherK8sVerifiedResponse) PrepareResponse(verified bool, container *client.Container, c *client.RancherClient) error {
+func (rvr *RancherK8sVerifiedResponse) PrepareResponse(verified bool, container *client.Container, tc *TopologyCache) error {
 
 	rvr.verified = verified
+	rvr.hostID = container.HostId
 
 	if _, ok := container.Labels["io.kubernetes.pod.namespace"].(string); !ok {
 		return errors.New("No pod namespace found")
@@ -20,7 +20,7 @@ func (rvr *RancherK8sVerifiedResponse) PrepareResponse(verified bool, container
 	}
 	rvr.namespace = container.Labels["io.kubernetes.pod.namespace"].(string)
 
-	project, err := getProjectFromAPIKey(c)
+	project, err := tc.ProjectForAPIKey()
 	if err != nil {
 		return err
 	}
@@ -36,15 +36,19 @@ func (rvr *RancherK8sVerifiedResponse) PrepareResponse(verified bool, container
 		rvr.id = container.ExternalId
 	}
 
-	return nil
+	rvr.path, err = rvr.pathTemplate.Render(&PathAttributes{
+		Environment: rvr.environmentName,
+		Namespace:   rvr.namespace,
+		LabelPath:   rvr.labelPath,
+		ID:          rvr.id,
+		Labels:      labelsToStrings(container.Labels),
+	})
+
+	return err
 }
 
 func (rvr *RancherK8sVerifiedResponse) Path() string {
-	if rvr.labelPath == "" {
-		return fmt.Sprintf("%s/%s/%s", rvr.environmentName, rvr.namespace, rvr.id)
-	}
-
-	return fmt.Sprintf("%s/%s/%s/%s", rvr.environmentName, rvr.namespace, rvr.labelPath, rvr.id)
+	return rvr.path
 }
 
 func (rvr *RancherK8sVerifiedResponse) Verified() bool {
@@ -54,3 +58,7 @@ func (rvr *RancherK8sVerifiedResponse) Verified() bool {
 func (rvr *RancherK8sVerifiedResponse) ID() string {
 	return rvr.id
 }
+
+func (rvr *RancherK8sVerifiedResponse) HostID() string {
+	return rvr.hostID
+}
@@ -0,0 +1,164 @@
+package verifier
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+const (
+	DefaultCattlePathTemplate = "{{.Environment}}/{{.Stack}}/{{.Service}}/{{.Container}}"
+	DefaultK8sPathTemplate    = "{{.Environment}}/{{.Namespace}}/{{with .LabelPath}}{{.}}/{{end}}{{.ID}}"
+)
+
+// PathAttributes are what a path template can reference, only LabelPath spans segments.
+type PathAttributes struct {
+	Environment string
+	Stack       string
+	Service     string
+	Container   string
+	Namespace   string
+	LabelPath   string
+	ID          string
+	Labels      map[string]string
+}
+
+type PathTemplate struct {
+	text string
+	tmpl *template.Template
+}
+
+type PathTemplates struct {
+	Cattle     *PathTemplate
+	Kubernetes *PathTemplate
+}
+
+// NewPathTemplate parses the template and tries it on sample attributes.
+func NewPathTemplate(text string) (*PathTemplate, error) {
+	tmpl, err := template.New("path").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid path template %q: %s", text, err)
+	}
+
+	pt := &PathTemplate{
+		text: text,
+		tmpl: tmpl,
+	}
+
+	sample := &PathAttributes{
+		Environment: "environment",
+		Stack:       "stack",
+		Service:     "service",
+		Container:   "container",
+		Namespace:   "namespace",
+		LabelPath:   "label/path",
+		ID:          "id",
+		Labels:      map[string]string{},
+	}
+	if _, err := pt.execute(sample); err != nil {
+		return nil, fmt.Errorf("Invalid path template %q: %s", text, err)
+	}
+
+	return pt, nil
+}
+
+func NewDefaultPathTemplates() *PathTemplates {
+	cattle, _ := NewPathTemplate(DefaultCattlePathTemplate)
+	k8s, _ := NewPathTemplate(DefaultK8sPathTemplate)
+
+	return &PathTemplates{
+		Cattle:     cattle,
+		Kubernetes: k8s,
+	}
+}
+
+func (pt *PathTemplate) String() string {
+	return pt.text
+}
+
+// Render refuses values adding segments, and empty, "." or ".." segments.
+func (pt *PathTemplate) Render(attrs *PathAttributes) (string, error) {
+	if err := attrs.validate(); err != nil {
+		return "", err
+	}
+
+	safe := *attrs
+	safe.Labels = map[string]string{}
+	refused := []string{}
+	for key, value := range attrs.Labels {
+		if strings.Contains(value, "/") {
+			refused = append(refused, key)
+			value = ""
+		}
+		safe.Labels[key] = value
+	}
+
+	path, err := pt.execute(&safe)
+	if err != nil {
+		return "", err
+	}
+
+	// a refused label is used when giving it a value changes the path
+	if len(refused) > 0 {
+		for _, key := range refused {
+			safe.Labels[key] = "refused"
+		}
+		if other, err := pt.execute(&safe); err != nil || other != path {
+			return "", errors.New("A label used in the path contains a /")
+		}
+	}
+
+	if path == "" {
+		return "", errors.New("Rendered path is empty")
+	}
+
+	for _, segment := range strings.Split(path, "/") {
+		switch segment {
+		case "":
+			return "", fmt.Errorf("Rendered path %q has an empty segment", path)
+		case ".", "..":
+			return "", fmt.Errorf("Rendered path %q has a %q segment", path, segment)
+		}
+	}
+
+	return path, nil
+}
+
+func (attrs *PathAttributes) validate() error {
+	values := []struct{ name, value string }{
+		{"Environment", attrs.Environment},
+		{"Stack", attrs.Stack},
+		{"Service", attrs.Service},
+		{"Container", attrs.Container},
+		{"Namespace", attrs.Namespace},
+		{"ID", attrs.ID},
+	}
+
+	for _, v := range values {
+		if strings.Contains(v.value, "/") {
+			return fmt.Errorf("%s %q contains a /", v.name, v.value)
+		}
+	}
+
+	return nil
+}
+
+func (pt *PathTemplate) execute(attrs *PathAttributes) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := pt.tmpl.Execute(buf, attrs); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func labelsToStrings(labels map[string]interface{}) map[string]string {
+	strLabels := map[string]string{}
+	for key, value := range labels {
+		if str, ok := value.(string); ok {
+			strLabels[key] = str
+		}
+	}
+	return strLabels
+}
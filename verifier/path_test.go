@@ -0,0 +1,160 @@
+package verifier
+
+import "testing"
+
+func TestPathTemplateRender(t *testing.T) {
+	base := PathAttributes{
+		Environment: "Default",
+		Stack:       "stack",
+		Service:     "service",
+		Container:   "container",
+		Namespace:   "namespace",
+		LabelPath:   "a/b",
+		ID:          "id",
+		Labels: map[string]string{
+			"team":                    "payments",
+			"io.rancher.container.ip": "10.42.0.1/16",
+			"nul":                     "a\x00b",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		change   func(*PathAttributes)
+		want     string
+		err      bool
+	}{
+		{
+			name:     "cattle default",
+			template: DefaultCattlePathTemplate,
+			want:     "Default/stack/service/container",
+		},
+		{
+			name:     "k8s default",
+			template: DefaultK8sPathTemplate,
+			want:     "Default/namespace/a/b/id",
+		},
+		{
+			name:     "k8s default without label path",
+			template: DefaultK8sPathTemplate,
+			change:   func(a *PathAttributes) { a.LabelPath = "" },
+			want:     "Default/namespace/id",
+		},
+		{
+			name:     "label",
+			template: `{{.Environment}}/{{index .Labels "team"}}/{{.Service}}`,
+			want:     "Default/payments/service",
+		},
+		{
+			name:     "unused label with a slash",
+			template: DefaultCattlePathTemplate,
+			want:     "Default/stack/service/container",
+		},
+		{
+			name:     "used label with a slash",
+			template: `{{.Environment}}/{{index .Labels "io.rancher.container.ip"}}`,
+			err:      true,
+		},
+		{
+			name:     "used label with a slash inside a segment",
+			template: `{{.Environment}}/{{index .Labels "io.rancher.container.ip"}}-net`,
+			err:      true,
+		},
+		{
+			name:     "label with a NUL",
+			template: `{{.Environment}}/{{index .Labels "nul"}}`,
+			want:     "Default/a\x00b",
+		},
+		{
+			name:     "missing label",
+			template: `{{.Environment}}/{{index .Labels "missing"}}/{{.Service}}`,
+			err:      true,
+		},
+		{
+			name:     "empty value",
+			template: DefaultCattlePathTemplate,
+			change:   func(a *PathAttributes) { a.Stack = "" },
+			err:      true,
+		},
+		{
+			name:     "value with a slash",
+			template: DefaultCattlePathTemplate,
+			change:   func(a *PathAttributes) { a.Service = "../../other" },
+			err:      true,
+		},
+		{
+			name:     "dot dot value",
+			template: DefaultCattlePathTemplate,
+			change:   func(a *PathAttributes) { a.Container = ".." },
+			err:      true,
+		},
+		{
+			name:     "dot value",
+			template: DefaultCattlePathTemplate,
+			change:   func(a *PathAttributes) { a.Stack = "." },
+			err:      true,
+		},
+		{
+			name:     "dot dot in label path",
+			template: DefaultK8sPathTemplate,
+			change:   func(a *PathAttributes) { a.LabelPath = "a/../../b" },
+			err:      true,
+		},
+		{
+			name:     "dots inside a segment",
+			template: DefaultCattlePathTemplate,
+			change:   func(a *PathAttributes) { a.Container = "app..1" },
+			want:     "Default/stack/service/app..1",
+		},
+		{
+			name:     "leading slash",
+			template: "/{{.Environment}}",
+			err:      true,
+		},
+		{
+			name:     "empty",
+			template: `{{index .Labels "missing"}}`,
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		pt, err := NewPathTemplate(test.template)
+		if err != nil {
+			t.Errorf("%s: parsing %q: %s", test.name, test.template, err)
+			continue
+		}
+
+		a := base
+		if test.change != nil {
+			test.change(&a)
+		}
+
+		got, err := pt.Render(&a)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNewPathTemplateInvalid(t *testing.T) {
+	for _, text := range []string{
+		"{{.Environment",
+		"{{.Unknown}}",
+	} {
+		if _, err := NewPathTemplate(text); err == nil {
+			t.Errorf("expected %q to be refused", text)
+		}
+	}
+}
@@ -1,23 +1,21 @@
 package verifier
 
 import (
-	"fmt"
-
 	"github.com/rancher/go-rancher/client"
 )
 
-func (rvr *RancherVerifiedResponse) PrepareResponse(verified bool, container *client.Container, c *client.RancherClient) error {
-	svc, err := getServiceFromContainer(c, container)
+func (rvr *RancherVerifiedResponse) PrepareResponse(verified bool, container *client.Container, tc *TopologyCache) error {
+	svc, err := tc.ServiceForContainer(container)
 	if err != nil {
 		return err
 	}
 
-	stk, err := getStackFromService(c, svc)
+	stk, err := tc.StackForService(svc)
 	if err != nil {
 		return err
 	}
 
-	env, err := getEnvFromStack(c, stk)
+	env, err := tc.ProjectForStack(stk)
 	if err != nil {
 		return err
 	}
@@ -28,12 +26,22 @@ func (rvr *RancherVerifiedResponse) PrepareResponse(verified bool, container *cl
 	rvr.environmentName = env.Name
 	rvr.containerName = container.Name
 	rvr.id = container.ExternalId
-
-	return nil
+	rvr.hostID = container.HostId
+
+	rvr.path, err = rvr.pathTemplate.Render(&PathAttributes{
+		Environment: rvr.environmentName,
+		Stack:       rvr.stackName,
+		Service:     rvr.serviceName,
+		Container:   rvr.containerName,
+		ID:          rvr.id,
+		Labels:      labelsToStrings(container.Labels),
+	})
+
+	return err
 }
 
 func (rvr *RancherVerifiedResponse) Path() string {
-	return fmt.Sprintf("%s/%s/%s/%s", rvr.environmentName, rvr.stackName, rvr.serviceName, rvr.containerName)
+	return rvr.path
 }
 
 func (rvr *RancherVerifiedResponse) Verified() bool {
@@ -43,3 +51,7 @@ func (rvr *RancherVerifiedResponse) Verified() bool {
 func (rvr *RancherVerifiedResponse) ID() string {
 	return rvr.id
 }
+
+func (rvr *RancherVerifiedResponse) HostID() string {
+	return rvr.hostID
+}
@@ -11,15 +11,16 @@ type VerifiedResponse interface {
 	Path() string
 	Verified() bool
 	ID() string
-	PrepareResponse(bool, *client.Container, *client.RancherClient) error
+	HostID() string
+	PrepareResponse(bool, *client.Container, *TopologyCache) error
 }
 
-func NewVerifiedResponse(msg *types.Message) (VerifiedResponse, error) {
+func NewVerifiedResponse(msg *types.Message, templates *PathTemplates) (VerifiedResponse, error) {
 	switch msg.ContainerType {
 	case "kubernetes":
-		return &RancherK8sVerifiedResponse{id: msg.Event.ID}, nil
+		return &RancherK8sVerifiedResponse{id: msg.Event.ID, pathTemplate: templates.Kubernetes}, nil
 	case "cattle":
-		return &RancherVerifiedResponse{}, nil
+		return &RancherVerifiedResponse{pathTemplate: templates.Cattle}, nil
 	default:
 		return nil, errors.New("Invalid Type")
 	}
@@ -32,6 +33,9 @@ type RancherVerifiedResponse struct {
 	containerName   string
 	environmentName string
 	id              string
+	hostID          string
+	path            string
+	pathTemplate    *PathTemplate
 }
 
 type RancherK8sVerifiedResponse struct {
@@ -40,4 +44,7 @@ type RancherK8sVerifiedResponse struct {
 	environmentName string
 	labelPath       string
 	id              string
+	hostID          string
+	path            string
+	pathTemplate    *PathTemplate
 }
@@ -2,11 +2,12 @@ package verifier
 
 import (
 	"errors"
+	"time"
 
 	"github.com/rancher/go-rancher/client"
 )
 
-func getProjectFromAPIKey(c *client.RancherClient) (*client.Project, error) {
+func getProjectFromAPIKey(c *client.RancherClient, name string) (*client.Project, error) {
 	projects, err := c.Project.List(&client.ListOpts{})
 	if err != nil {
 		return nil, err
@@ -16,7 +17,17 @@ func getProjectFromAPIKey(c *client.RancherClient) (*client.Project, error) {
 		return nil, errors.New("No project found for key")
 	}
 
-	return &projects.Data[0], nil
+	if name == "" {
+		return &projects.Data[0], nil
+	}
+
+	for i := range projects.Data {
+		if projects.Data[i].Name == name {
+			return &projects.Data[i], nil
+		}
+	}
+
+	return nil, errors.New("No project named " + name + " found for key")
 }
 
 func getServiceFromContainer(c *client.RancherClient, container *client.Container) (*client.Service, error) {
@@ -35,17 +46,52 @@ func getServiceFromContainer(c *client.RancherClient, container *client.Containe
 func getStackFromService(c *client.RancherClient, service *client.Service) (*client.Environment, error) {
 	var stack *client.Environment
 	err := c.GetLink(service.Resource, "environment", &stack)
-	if err != nil || stack.Name == "" {
+	if err != nil {
 		return nil, err
 	}
+	if stack == nil || stack.Name == "" {
+		return nil, errors.New("Error: Could not find the stack for service " + service.Name)
+	}
 	return stack, nil
 }
 
 func getEnvFromStack(c *client.RancherClient, stk *client.Environment) (*client.Project, error) {
 	var environment *client.Project
 	err := c.GetLink(stk.Resource, "account", &environment)
-	if err != nil || environment.Name == "" {
+	if err != nil {
 		return nil, err
 	}
+	if environment == nil || environment.Name == "" {
+		return nil, errors.New("Error: Could not find the environment for stack " + stk.Name)
+	}
 	return environment, nil
 }
+
+// CheckAPIKey returns the API key's environment and how many it can see.
+func CheckAPIKey(config *VerifierConfig) (*client.Project, int, error) {
+	c, err := client.NewRancherClient(&client.ClientOpts{
+		Url:       config.RancherUrl,
+		AccessKey: config.rancherAccessKey,
+		SecretKey: config.rancherSecretKey,
+		Timeout:   10 * time.Second,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	projects, err := c.Project.List(&client.ListOpts{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	project, err := getProjectFromAPIKey(c, config.EnvironmentName)
+	if err != nil {
+		return nil, len(projects.Data), err
+	}
+
+	if _, err := c.Container.List(&client.ListOpts{Filters: map[string]interface{}{"limit": 1}}); err != nil {
+		return project, len(projects.Data), err
+	}
+
+	return project, len(projects.Data), nil
+}
@@ -1,6 +1,14 @@
 package writer
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
@@ -8,24 +16,41 @@ import (
 	"golang.org/x/net/context"
 )
 
-type DockerContainerFSWriter struct {
-	message      string
-	path         string
-	dockerClient *client.Client
-	containerId  string
+// ReadySuffix names the file holding the SHA-256 of the complete secret file.
+const ReadySuffix = ".ready"
+
+// inPlace remembers the containers mv didn't work in, so the file isn't
+// uploaded twice on every delivery to them.
+var inPlace = struct {
+	sync.Mutex
+	containers map[string]bool
+}{containers: map[string]bool{}}
+
+// ForgetContainer drops what was learned about writing to a container.
+func ForgetContainer(containerID string) {
+	inPlace.Lock()
+	defer inPlace.Unlock()
+
+	delete(inPlace.containers, containerID)
 }
 
-type SecretWriter interface {
-	Write() error
+func writesInPlace(containerID string) bool {
+	inPlace.Lock()
+	defer inPlace.Unlock()
+
+	return inPlace.containers[containerID]
 }
 
-func NewSecretWriter(config map[string]interface{}) (SecretWriter, error) {
-	return NewDockerContainerFSWriter(config)
+type DockerContainerFSWriter struct {
+	secretFile
+	path         string
+	dockerClient *client.Client
+	containerId  string
 }
 
 func NewDockerContainerFSWriter(opts map[string]interface{}) (*DockerContainerFSWriter, error) {
 	return &DockerContainerFSWriter{
-		message:      opts["message"].(string),
+		secretFile:   newSecretFile(opts),
 		path:         opts["path"].(string),
 		dockerClient: opts["dockerClient"].(*client.Client),
 		containerId:  opts["containerId"].(string),
@@ -36,26 +61,81 @@ func (d *DockerContainerFSWriter) Write() error {
 	// this will log the temp token.. but with short TTLs
 	// the debug value outweighs the risk.
 	logrus.Debugf("Writing message: %#v", d.message)
-	files := []archive.ArchiveFile{
-		{"secrets.txt", d.message},
-	}
-	tarball, err := archive.CreateTarArchive(files)
+
+	// verify the path
+	_, err := d.dockerClient.ContainerStatPath(context.Background(), d.containerId, d.path)
 	if err != nil {
-		logrus.Error("Failed to create Tar file")
 		return err
 	}
 
-	// verify the path
-	_, err = d.dockerClient.ContainerStatPath(context.Background(), d.containerId, d.path)
+	if _, err := d.dockerClient.ContainerStatPath(context.Background(), d.containerId, path.Join(d.path, d.filename)); err == nil {
+		logrus.Infof("Replacing %s in container %s", path.Join(d.path, d.filename), d.containerId)
+	}
+
+	// a container that isn't running has nobody to read a partial file,
+	// and can't exec the rename anyway
+	atomic := d.running() && !writesInPlace(d.containerId)
+	if atomic {
+		err = d.replace()
+		if err != nil {
+			logrus.Warnf("Could not atomically replace %s in container %s, writing it in place from now on: %s", d.filename, d.containerId, err)
+			inPlace.Lock()
+			inPlace.containers[d.containerId] = true
+			inPlace.Unlock()
+		}
+	}
+
+	if !atomic || err != nil {
+		if err := d.copy(d.filename, d.message); err != nil {
+			return err
+		}
+	}
+
+	sum := sha256.Sum256([]byte(d.message))
+	return d.copy(d.filename+ReadySuffix, hex.EncodeToString(sum[:])+"\n")
+}
+
+// replace uploads the file under a hidden name and moves it into place.
+func (d *DockerContainerFSWriter) replace() error {
+	tmpName := "." + d.filename + ".tmp-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	tmpPath := path.Join(d.path, tmpName)
+	user := fmt.Sprintf("%d:%d", d.uid, d.gid)
+
+	if err := d.copy(tmpName, d.message); err != nil {
+		return err
+	}
+
+	err := Exec(d.dockerClient, d.containerId, user, []string{"mv", "-f", tmpPath, path.Join(d.path, d.filename)}, "")
 	if err != nil {
+		if rmErr := Exec(d.dockerClient, d.containerId, user, []string{"rm", "-f", tmpPath}, ""); rmErr != nil {
+			// the copy API can't delete, so at least don't leave the token
+			logrus.Errorf("Could not remove %s in container %s, emptying it: %s", tmpPath, d.containerId, rmErr)
+			if blankErr := d.copy(tmpName, ""); blankErr != nil {
+				logrus.Errorf("Could not empty %s in container %s: %s", tmpPath, d.containerId, blankErr)
+			}
+		}
 		return err
 	}
 
-	opts := types.CopyToContainerOptions{}
+	return nil
+}
+
+func (d *DockerContainerFSWriter) running() bool {
+	info, err := d.dockerClient.ContainerInspect(context.Background(), d.containerId)
+	return err == nil && info.State != nil && info.State.Running
+}
 
-	if err = d.dockerClient.CopyToContainer(context.Background(), d.containerId, d.path, tarball, opts); err != nil {
+func (d *DockerContainerFSWriter) copy(name, content string) error {
+	files := []archive.ArchiveFile{
+		{Name: name, Content: content, Mode: d.mode, Uid: d.uid, Gid: d.gid},
+	}
+	tarball, err := archive.CreateTarArchive(files)
+	if err != nil {
+		logrus.Error("Failed to create Tar file")
 		return err
 	}
 
-	return nil
+	opts := types.CopyToContainerOptions{}
+
+	return d.dockerClient.CopyToContainer(context.Background(), d.containerId, d.path, tarball, opts)
 }
@@ -0,0 +1,140 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"golang.org/x/net/context"
+)
+
+const maxExecOutput = 4096
+
+// ExecWriter hands the secret to a command run inside the container on its
+// stdin, so it is never written to disk by the agent.
+type ExecWriter struct {
+	secretFile
+	command      []string
+	dockerClient *client.Client
+	containerId  string
+}
+
+func NewExecWriter(opts map[string]interface{}) (*ExecWriter, error) {
+	command, _ := opts["command"].([]string)
+	if len(command) == 0 {
+		return nil, fmt.Errorf("No command configured for the exec writer")
+	}
+
+	return &ExecWriter{
+		secretFile:   newSecretFile(opts),
+		command:      command,
+		dockerClient: opts["dockerClient"].(*client.Client),
+		containerId:  opts["containerId"].(string),
+	}, nil
+}
+
+func (e *ExecWriter) Write() error {
+	logrus.Debugf("Streaming message to %v in container %s: %#v", e.command, e.containerId, e.message)
+	return Exec(e.dockerClient, e.containerId, fmt.Sprintf("%d:%d", e.uid, e.gid), e.command, e.message)
+}
+
+// Exec runs command in the container as user with stdin on its standard
+// input, and fails unless it exits with 0.
+func Exec(dockerClient *client.Client, containerID, user string, command []string, stdin string) error {
+	ctx := context.Background()
+
+	config := types.ExecConfig{
+		User:         user,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          command,
+	}
+
+	exec, err := dockerClient.ContainerExecCreate(ctx, containerID, config)
+	if err != nil {
+		return err
+	}
+
+	resp, err := dockerClient.ContainerExecAttach(ctx, exec.ID, config)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	if _, err := io.WriteString(resp.Conn, stdin); err != nil {
+		return err
+	}
+	if err := resp.CloseWrite(); err != nil {
+		return err
+	}
+
+	output, err := readExecOutput(resp.Reader)
+	if err != nil {
+		return err
+	}
+
+	exitCode, err := execExitCode(dockerClient, exec.ID)
+	if err != nil {
+		return fmt.Errorf("Command %s in container %s: %s", strings.Join(command, " "), containerID, err)
+	}
+
+	if exitCode != 0 {
+		return fmt.Errorf("Command %s in container %s exited with %d: %s", strings.Join(command, " "), containerID, exitCode, strings.TrimSpace(output))
+	}
+
+	return nil
+}
+
+// execExitCode waits a moment for Docker to notice the command is done, its
+// output closing can be seen first.
+func execExitCode(dockerClient *client.Client, execID string) (int, error) {
+	for i := 0; i < 50; i++ {
+		inspect, err := dockerClient.ContainerExecInspect(context.Background(), execID)
+		if err != nil {
+			return 0, err
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return 0, fmt.Errorf("did not finish")
+}
+
+// readExecOutput reads Docker's multiplexed stdout and stderr stream until
+// it ends, keeping the first few KB for error messages.
+func readExecOutput(r io.Reader) (string, error) {
+	buf := &bytes.Buffer{}
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return buf.String(), nil
+			}
+			return buf.String(), err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		keep := int64(maxExecOutput - buf.Len())
+		if keep > size {
+			keep = size
+		}
+
+		if _, err := io.CopyN(buf, r, keep); err != nil {
+			return buf.String(), err
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, size-keep); err != nil {
+			return buf.String(), err
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package writer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// RootfsWriter writes the secret file through the container's root as seen
+// from the host, e.g. /proc/<pid>/root, for runtimes without a copy API.
+type RootfsWriter struct {
+	secretFile
+	path   string
+	rootfs string
+}
+
+func NewRootfsWriter(opts map[string]interface{}) (*RootfsWriter, error) {
+	rootfs, _ := opts["rootfs"].(string)
+	if rootfs == "" {
+		return nil, fmt.Errorf("No container root for the rootfs writer")
+	}
+
+	return &RootfsWriter{
+		secretFile: newSecretFile(opts),
+		path:       opts["path"].(string),
+		rootfs:     rootfs,
+	}, nil
+}
+
+func (r *RootfsWriter) Write() error {
+	dir, err := OpenInRoot(r.rootfs, r.path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	// every write goes through the opened directory, so the container
+	// can't swap a symlink in after it was checked
+	base := dirPath(dir)
+
+	logrus.Debugf("Writing message to %s: %#v", dir.Name(), r.message)
+	if err := writeFileAtomic(filepath.Join(base, r.filename), r.message, os.FileMode(r.mode), r.uid, r.gid); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256([]byte(r.message))
+	return writeFileAtomic(filepath.Join(base, r.filename+ReadySuffix), hex.EncodeToString(sum[:])+"\n", os.FileMode(r.mode), r.uid, r.gid)
+}
+
+// ReadInRoot reads the file p inside rootfs, refusing symlinks like
+// OpenInRoot.
+func ReadInRoot(rootfs, p string) ([]byte, error) {
+	p = filepath.Clean("/" + p)
+
+	dir, err := OpenInRoot(rootfs, filepath.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	file, err := openFileAt(dir, filepath.Base(p))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+func symlinkError(p string) error {
+	return fmt.Errorf("Refusing to follow symlink %s in container", p)
+}
@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+package writer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// OpenInRoot opens the directory p inside rootfs, refusing symlinks.
+func OpenInRoot(rootfs, p string) (*os.File, error) {
+	fd, err := syscall.Open(rootfs, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: rootfs, Err: err}
+	}
+
+	current := "/"
+	for _, segment := range strings.Split(filepath.Clean("/"+p), "/") {
+		if segment == "" {
+			continue
+		}
+		current = filepath.Join(current, segment)
+
+		next, err := syscall.Openat(fd, segment, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		syscall.Close(fd)
+		if err == syscall.ELOOP || err == syscall.ENOTDIR && isSymlink(filepath.Join(rootfs, current)) {
+			return nil, symlinkError(current)
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: filepath.Join(rootfs, current), Err: err}
+		}
+		fd = next
+	}
+
+	return os.NewFile(uintptr(fd), filepath.Join(rootfs, current)), nil
+}
+
+// isSymlink tells why O_DIRECTORY refused p. Linux checks O_DIRECTORY
+// before O_NOFOLLOW, so a symlink fails with ENOTDIR and not ELOOP.
+func isSymlink(p string) bool {
+	info, err := os.Lstat(p)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// openFileAt opens the file name in dir without following a symlink.
+func openFileAt(dir *os.File, name string) (*os.File, error) {
+	fd, err := syscall.Openat(int(dir.Fd()), name, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err == syscall.ELOOP {
+		return nil, symlinkError(name)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(dir.Name(), name), Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), filepath.Join(dir.Name(), name)), nil
+}
+
+// dirPath names the opened directory itself, whatever happens to the path
+// it was opened by.
+func dirPath(dir *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", dir.Fd())
+}
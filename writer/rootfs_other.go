@@ -0,0 +1,49 @@
+//go:build !linux
+// +build !linux
+
+package writer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OpenInRoot opens the directory p inside rootfs, refusing symlinks racily.
+func OpenInRoot(rootfs, p string) (*os.File, error) {
+	current := rootfs
+	for _, segment := range strings.Split(filepath.Clean("/"+p), "/") {
+		if segment == "" {
+			continue
+		}
+
+		current = filepath.Join(current, segment)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil, symlinkError(strings.TrimPrefix(current, rootfs))
+		}
+	}
+
+	return os.Open(current)
+}
+
+func openFileAt(dir *os.File, name string) (*os.File, error) {
+	p := filepath.Join(dir.Name(), name)
+
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil, symlinkError(name)
+	}
+
+	return os.Open(p)
+}
+
+func dirPath(dir *os.File) string {
+	return dir.Name()
+}
@@ -0,0 +1,153 @@
+package writer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRoot builds a container root with a /run/secrets directory, a
+// symlinked /var/run and a symlinked /etc/passwd pointing at the host.
+func testRoot(t *testing.T) string {
+	rootfs, err := ioutil.TempDir("", "secrets-bridge-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"run/secrets", "var", "etc"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc/group"), []byte("root:x:0:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/run", filepath.Join(rootfs, "var/run")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd", filepath.Join(rootfs, "etc/passwd")); err != nil {
+		t.Fatal(err)
+	}
+
+	return rootfs
+}
+
+func TestOpenInRoot(t *testing.T) {
+	rootfs := testRoot(t)
+	defer os.RemoveAll(rootfs)
+
+	tests := []struct {
+		path    string
+		want    string
+		symlink bool
+		missing bool
+	}{
+		{path: "/", want: ""},
+		{path: "/run/secrets", want: "/run/secrets"},
+		{path: "run/secrets/", want: "/run/secrets"},
+		{path: "/../../run", want: "/run"},
+		{path: "/var/run/secrets", symlink: true},
+		{path: "/var/run", symlink: true},
+		{path: "/run/missing", missing: true},
+		{path: "/etc/group", missing: true},
+	}
+
+	for _, test := range tests {
+		dir, err := OpenInRoot(rootfs, test.path)
+		switch {
+		case test.symlink:
+			if err == nil || !strings.Contains(err.Error(), "symlink") {
+				t.Errorf("%s: expected the symlink to be refused, got %v", test.path, err)
+			}
+		case test.missing:
+			if err == nil {
+				t.Errorf("%s: expected an error", test.path)
+			}
+		case err != nil:
+			t.Errorf("%s: unexpected error: %s", test.path, err)
+		case dir.Name() != rootfs+test.want:
+			t.Errorf("%s: opened %s, want %s", test.path, dir.Name(), rootfs+test.want)
+		}
+
+		if dir != nil {
+			dir.Close()
+		}
+	}
+}
+
+func TestReadInRoot(t *testing.T) {
+	rootfs := testRoot(t)
+	defer os.RemoveAll(rootfs)
+
+	tests := []struct {
+		path string
+		want string
+		err  bool
+	}{
+		{path: "/etc/group", want: "root:x:0:\n"},
+		{path: "etc/../etc/group", want: "root:x:0:\n"},
+		{path: "/etc/passwd", err: true},
+		{path: "/var/run/passwd", err: true},
+		{path: "/etc/shadow", err: true},
+	}
+
+	for _, test := range tests {
+		content, err := ReadInRoot(rootfs, test.path)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, read %q", test.path, content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.path, err)
+			continue
+		}
+		if string(content) != test.want {
+			t.Errorf("%s: read %q, want %q", test.path, content, test.want)
+		}
+	}
+}
+
+func TestRootfsWriter(t *testing.T) {
+	rootfs := testRoot(t)
+	defer os.RemoveAll(rootfs)
+
+	opts := map[string]interface{}{
+		"message": "export TEMP_TOKEN=token\n",
+		"path":    "/run/secrets",
+		"rootfs":  rootfs,
+		"uid":     os.Getuid(),
+		"gid":     os.Getgid(),
+	}
+
+	w, err := NewRootfsWriter(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(rootfs, "run/secrets", SecretsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "export TEMP_TOKEN=token\n" {
+		t.Errorf("wrote %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "run/secrets", SecretsFileName+ReadySuffix)); err != nil {
+		t.Errorf("no ready file: %s", err)
+	}
+
+	opts["path"] = "/var/run/secrets"
+	w, err = NewRootfsWriter(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(); err == nil {
+		t.Error("expected a write through a symlink to be refused")
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package writer
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// PrepareVolumeDir creates volumeDir and mounts a tmpfs on it, unless one
+// is already there, so delivered secrets never reach the host's disk.
+func PrepareVolumeDir(volumeDir string) error {
+	volumeDir = filepath.Clean(volumeDir)
+
+	if err := os.MkdirAll(volumeDir, 0755); err != nil {
+		return err
+	}
+
+	mounted, err := isTmpfs(volumeDir)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return nil
+	}
+
+	logrus.Infof("Mounting tmpfs on %s", volumeDir)
+	return syscall.Mount("tmpfs", volumeDir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=0755")
+}
+
+func isTmpfs(dir string) (bool, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 2 && fields[1] == dir && fields[2] == "tmpfs" {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package writer
+
+import (
+	"os"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// PrepareVolumeDir only creates volumeDir, tmpfs mounts need Linux.
+func PrepareVolumeDir(volumeDir string) error {
+	logrus.Warnf("Not mounting a tmpfs on %s, secrets written there may reach disk", volumeDir)
+	return os.MkdirAll(volumeDir, 0755)
+}
@@ -0,0 +1,302 @@
+package writer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"golang.org/x/net/context"
+)
+
+// VolumeWriter writes the secret file into the container's mounted directory under volumeDir.
+type VolumeWriter struct {
+	secretFile
+	path         string
+	volumeDir    string
+	stateDir     string
+	dockerClient *client.Client
+	containerId  string
+}
+
+func NewVolumeWriter(opts map[string]interface{}) (*VolumeWriter, error) {
+	volumeDir, _ := opts["volumeDir"].(string)
+	if volumeDir == "" {
+		return nil, fmt.Errorf("No volume dir configured for the volume writer")
+	}
+
+	return &VolumeWriter{
+		secretFile:   newSecretFile(opts),
+		path:         opts["path"].(string),
+		volumeDir:    filepath.Clean(volumeDir),
+		stateDir:     stateDirOpt(opts),
+		dockerClient: opts["dockerClient"].(*client.Client),
+		containerId:  opts["containerId"].(string),
+	}, nil
+}
+
+func (v *VolumeWriter) Write() error {
+	dir, err := v.Prepare()
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("Writing message to %s: %#v", dir, v.message)
+	if err := writeFileAtomic(filepath.Join(dir, v.filename), v.message, os.FileMode(v.mode), v.uid, v.gid); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256([]byte(v.message))
+	return writeFileAtomic(filepath.Join(dir, v.filename+ReadySuffix), hex.EncodeToString(sum[:])+"\n", os.FileMode(v.mode), v.uid, v.gid)
+}
+
+// Prepare makes the container's directory under volumeDir, before Docker
+// would create it for the mount, and returns it.
+func (v *VolumeWriter) Prepare() (string, error) {
+	dir, err := v.hostDir()
+	if err != nil {
+		return "", err
+	}
+
+	if err := v.claim(dir); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+func stateDirOpt(opts map[string]interface{}) string {
+	stateDir, _ := opts["stateDir"].(string)
+	return stateDir
+}
+
+// hostDir finds the host side of the mount at path, directly under volumeDir.
+func (v *VolumeWriter) hostDir() (string, error) {
+	info, err := v.dockerClient.ContainerInspect(context.Background(), v.containerId)
+	if err != nil {
+		return "", err
+	}
+
+	for _, mount := range info.Mounts {
+		if filepath.Clean(mount.Destination) != v.path {
+			continue
+		}
+
+		source := filepath.Clean(mount.Source)
+		if filepath.Dir(source) != v.volumeDir {
+			return "", fmt.Errorf("Mount at %s in container %s is not a directory in %s: %s", v.path, v.containerId, v.volumeDir, source)
+		}
+		return source, nil
+	}
+
+	return "", fmt.Errorf("Container %s has no volume mounted at %s", v.containerId, v.path)
+}
+
+// claim creates dir for the container, refusing one in use or not the agent's.
+func (v *VolumeWriter) claim(dir string) error {
+	if v.stateDir == "" {
+		return fmt.Errorf("The volume writer needs a state dir to record which container owns %s", dir)
+	}
+
+	volumeOwnersMu.Lock()
+	defer volumeOwnersMu.Unlock()
+
+	ownersDir := filepath.Join(v.stateDir, volumeOwnersDir)
+	if err := os.MkdirAll(ownersDir, 0700); err != nil {
+		return err
+	}
+
+	name := filepath.Base(dir)
+	owners, err := readVolumeOwners(ownersDir)
+	if err != nil {
+		return err
+	}
+
+	owner, ok := owners[name]
+	if ok && owner != v.containerId {
+		if _, err := v.dockerClient.ContainerInspect(context.Background(), owner); err == nil {
+			return fmt.Errorf("Volume %s is already used by container %s", dir, owner)
+		}
+		if err := writeVolumeRecord(ownersDir, owner, name, false); err != nil {
+			return err
+		}
+	}
+
+	if err := v.makeDir(dir, ok); err != nil {
+		return err
+	}
+
+	if ok && owner == v.containerId {
+		return nil
+	}
+	return writeVolumeRecord(ownersDir, v.containerId, name, true)
+}
+
+// makeDir creates dir, or takes over the one the agent recorded before.
+func (v *VolumeWriter) makeDir(dir string, recorded bool) error {
+	info, err := os.Lstat(dir)
+	switch {
+	case os.IsNotExist(err):
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case !recorded:
+		return fmt.Errorf("Volume %s was not created by the agent", dir)
+	case !info.IsDir():
+		return fmt.Errorf("Volume %s is not a directory", dir)
+	}
+
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+	return os.Chown(dir, v.uid, v.gid)
+}
+
+// RemoveVolume deletes the directories under volumeDir owned by the
+// container.
+func RemoveVolume(volumeDir, stateDir, containerID string) error {
+	if volumeDir == "" || stateDir == "" || containerID == "" {
+		return nil
+	}
+
+	volumeOwnersMu.Lock()
+	defer volumeOwnersMu.Unlock()
+
+	ownersDir := filepath.Join(stateDir, volumeOwnersDir)
+	names, err := readVolumeRecord(ownersDir, containerID)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		path := filepath.Join(volumeDir, name)
+		logrus.Debugf("Removing volume %s of container %s", path, containerID)
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(filepath.Join(ownersDir, containerID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// volumeOwnersDir lists the directories each container owns, in the state dir.
+const volumeOwnersDir = "volume-owners"
+
+var volumeOwnersMu sync.Mutex
+
+func readVolumeOwners(ownersDir string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(ownersDir)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := map[string]string{}
+	for _, file := range files {
+		names, err := readVolumeRecord(ownersDir, file.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			owners[name] = file.Name()
+		}
+	}
+
+	return owners, nil
+}
+
+// readVolumeRecord returns the directory names recorded for the container,
+// anything that isn't a plain name is ignored.
+func readVolumeRecord(ownersDir, containerID string) ([]string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(ownersDir, containerID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, name := range strings.Split(string(content), "\n") {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// writeVolumeRecord adds name to the container's record, or drops it.
+func writeVolumeRecord(ownersDir, containerID, name string, add bool) error {
+	names, err := readVolumeRecord(ownersDir, containerID)
+	if err != nil {
+		return err
+	}
+
+	kept := []string{}
+	for _, existing := range names {
+		if existing != name {
+			kept = append(kept, existing)
+		}
+	}
+	if add {
+		kept = append(kept, name)
+	}
+
+	path := filepath.Join(ownersDir, containerID)
+	if len(kept) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return writeFileAtomic(path, strings.Join(kept, "\n")+"\n", 0600, os.Getuid(), os.Getgid())
+}
+
+// writeFileAtomic writes to a hidden file next to name and renames it into
+// place, so readers see either the old file or the whole new one.
+func writeFileAtomic(name, content string, mode os.FileMode, uid, gid int) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+
+	if err := writeTemp(tmp, content, mode, uid, gid); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+func writeTemp(tmp *os.File, content string, mode os.FileMode, uid, gid int) error {
+	defer tmp.Close()
+
+	if _, err := tmp.WriteString(content); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if err := tmp.Chown(uid, gid); err != nil {
+		return err
+	}
+	return tmp.Sync()
+}
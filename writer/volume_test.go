@@ -0,0 +1,54 @@
+package writer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVolumeMakeDir(t *testing.T) {
+	volumeDir, err := ioutil.TempDir("", "secrets-bridge-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(volumeDir)
+
+	if err := os.Mkdir(filepath.Join(volumeDir, "existing"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(volumeDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		recorded bool
+		err      bool
+	}{
+		{"new", false, false},
+		{"existing", false, true},
+		{"existing", true, false},
+		{"link", false, true},
+		{"link", true, true},
+	}
+
+	v := &VolumeWriter{secretFile: secretFile{uid: os.Getuid(), gid: os.Getgid()}}
+	for _, test := range tests {
+		dir := filepath.Join(volumeDir, test.name)
+		err := v.makeDir(dir, test.recorded)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s, recorded %t: expected an error", test.name, test.recorded)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s, recorded %t: unexpected error: %s", test.name, test.recorded, err)
+			continue
+		}
+		if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+			t.Errorf("%s, recorded %t: directory is %v, %v, want mode 0700", test.name, test.recorded, info, err)
+		}
+	}
+}
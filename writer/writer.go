@@ -0,0 +1,65 @@
+package writer
+
+import "fmt"
+
+const (
+	SecretsFileName = "secrets.txt"
+
+	ContainerFSWriterType = "container"
+	VolumeWriterType      = "volume"
+	ExecWriterType        = "exec"
+)
+
+type SecretWriter interface {
+	Write() error
+}
+
+func NewSecretWriter(config map[string]interface{}) (SecretWriter, error) {
+	writerType, _ := config["writer"].(string)
+
+	switch writerType {
+	case "", ContainerFSWriterType:
+		return NewDockerContainerFSWriter(config)
+	case VolumeWriterType:
+		return NewVolumeWriter(config)
+	case ExecWriterType:
+		return NewExecWriter(config)
+	default:
+		return nil, fmt.Errorf("Unknown secret writer: %s", writerType)
+	}
+}
+
+// secretFile is the file every writer delivers, whatever the transport.
+type secretFile struct {
+	message  string
+	filename string
+	mode     int64
+	uid      int
+	gid      int
+}
+
+func newSecretFile(opts map[string]interface{}) secretFile {
+	f := secretFile{
+		message:  opts["message"].(string),
+		filename: SecretsFileName,
+		mode:     0600,
+	}
+
+	if filename, ok := opts["filename"].(string); ok && filename != "" {
+		f.filename = filename
+	}
+
+	if mode, ok := opts["mode"].(int64); ok && mode != 0 {
+		f.mode = mode
+	}
+
+	if uid, ok := opts["uid"].(int); ok {
+		f.uid = uid
+	}
+
+	if gid, ok := opts["gid"].(int); ok {
+		f.gid = gid
+	}
+
+	return f
+}